@@ -0,0 +1,414 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "math"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+
+
+// timing analysis
+const(
+    pauseDits       = 10.0      // a longer space is a break in sending, not part of it
+    trendMarks      = 40        // marks in each point of the speed trend
+    singleLength    = 1.8       // marks all within this ratio are taken to be all dits
+    )
+
+
+
+/**
+ * How one kind of element or space compares with the ideal.  Lengths are
+ * in dits at the detected speed.
+ */
+type timingStats struct {
+    Count           int         `json:"count"`
+    MeanDits        float64     `json:"meanDits"`
+    IdealDits       float64     `json:"idealDits"`
+    ErrorPercent    float64     `json:"errorPercent"`   // mean distance from the ideal
+    SpreadPercent   float64     `json:"spreadPercent"`  // standard deviation over the mean
+}
+
+
+
+// the speed over one stretch of sending
+type trendPoint struct {
+    Minute          float64     `json:"minute"`         // from the first event
+    Wpm             float64     `json:"wpm"`
+}
+
+
+
+/**
+ * An operator's fist, as the analyser reports it.
+ */
+type fistReport struct {
+    Sender          string      `json:"sender"`
+    Text            string      `json:"text"`
+    Wpm             float64     `json:"wpm"`
+    DitMs           float64     `json:"ditMs"`
+    DahDitRatio     float64     `json:"dahDitRatio"`
+    Dits            timingStats `json:"dits"`
+    Dahs            timingStats `json:"dahs"`
+    ElementSpaces   timingStats `json:"elementSpaces"`
+    CharacterSpaces timingStats `json:"characterSpaces"`
+    WordSpaces      timingStats `json:"wordSpaces"`
+    Pauses          int         `json:"pauses"`
+    Trend           []trendPoint `json:"speedTrend"`
+    TrendWpmPerMinute float64   `json:"trendWpmPerMinute"`
+    Consistency     float64     `json:"consistency"`    // 0 to 100
+}
+
+
+
+/**
+ * Report on the timing of each operator's sending in a session.
+ *
+ *      telegraph-tool analyse [-sender local] [-channel name] [-json] session.log
+ *
+ * The client's own key is recorded as sender "local".  Timing comes from
+ * each sender's own timestamps, so network delay does not count against
+ * them.
+ *
+ * @param   args    the command line after "analyse"
+ * @return  error   set if the session could not be analysed
+ */
+func analyseCommand(args []string) error {
+    flags := flag.NewFlagSet("analyse", flag.ContinueOnError)
+    channel := flags.String("channel", "", "only analyse events recorded on this channel")
+    sender := flags.String("sender", "", "only analyse this sender, \"local\" for the client's own key")
+    asJson := flags.Bool("json", false, "write the reports as JSON")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if flags.NArg() != 1 {
+        return errors.New("give one session log to analyse")
+    }
+    events, err := readSession(flags.Arg(0))
+    if err != nil {
+        return err
+    }
+    events = selectEvents(events, *channel, *sender)
+    if 0 == len(events) {
+        return errors.New("no key events to analyse")
+    }
+
+    bySender := make(map[string][]sessionEvent)
+    var senders []string
+    for _, e := range events {
+        if nil == bySender[e.Sender] {
+            senders = append(senders, e.Sender)
+        }
+        bySender[e.Sender] = append(bySender[e.Sender], e)
+    }
+    sort.Strings(senders)
+
+    var reports []fistReport
+    for _, s := range senders {
+        report, err := analyseFist(s, bySender[s])
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "sender", s + ":", err)
+            continue
+        }
+        reports = append(reports, report)
+    }
+    if 0 == len(reports) {
+        return errors.New("not enough sending to analyse")
+    }
+
+    if *asJson {
+        encoded, err := json.MarshalIndent(reports, "", "  ")
+        if err != nil {
+            return err
+        }
+        fmt.Println(string(encoded))
+        return nil
+    }
+    for _, report := range reports {
+        report.print()
+    }
+    return nil
+}
+
+
+
+/**
+ * Analyse one sender's key events.
+ *
+ * The marks are split into dits and dahs where the two groups of lengths
+ * fall apart, and the mean dit sets the speed everything is measured
+ * against.  Spaces under 2 dits are element spaces, under 5 character
+ * spaces and up to pauseDits word spaces, as the decoder reads them.
+ *
+ * The consistency score is 100 less 200 times the average spread of
+ * the dits, dahs and element spaces, so a spread of 10% scores 80 and
+ * 50% or more scores 0.
+ *
+ * @param   sender  the sender id
+ * @param   events  the sender's key events, in order
+ * @return  fistReport  the analysis
+ * @return  error   set if there is too little sending to analyse
+ */
+func analyseFist(sender string, events []sessionEvent) (fistReport, error) {
+    report := fistReport{Sender: sender}
+
+    // the key's marks and spaces, from the sender's own clock
+    var marks, spaces []time.Duration
+    var markStarts []time.Duration
+    var edges []toneEdge
+    first := events[0].SentUs
+    isDown := false
+    var lastUs int64
+    for _, e := range events {
+        if e.Down == isDown {
+            continue                            // repeated, as after a reconnect
+        }
+        at := time.Duration(e.SentUs - first) * time.Microsecond
+        length := time.Duration(e.SentUs - lastUs) * time.Microsecond
+        if (!e.Down && length <= 0) || (e.Down && lastUs != 0 && length < 0) {
+            return report, fmt.Errorf("the sender's clock went back or stood still at %v", at)
+        }
+        if e.Down {
+            if lastUs != 0 {
+                spaces = append(spaces, length)
+            }
+            markStarts = append(markStarts, at)
+        } else {
+            marks = append(marks, length)
+        }
+        edges = append(edges, toneEdge{at: at, down: e.Down})
+        isDown, lastUs = e.Down, e.SentUs
+    }
+    if isDown {
+        markStarts = markStarts[:len(markStarts) - 1]   // still down at the end, no length
+    }
+    if len(marks) < 2 {
+        return report, errors.New("fewer than two elements")
+    }
+
+    threshold := markThreshold(marks)
+    var dits, dahs []float64
+    for _, mark := range marks {
+        if mark < threshold {
+            dits = append(dits, float64(mark))
+        } else {
+            dahs = append(dahs, float64(mark))
+        }
+    }
+    if 0 == len(dits) {
+        return report, errors.New("no dits to measure the speed by")
+    }
+    dit := mean(dits)
+    report.DitMs = round2(dit / float64(time.Millisecond))
+    report.Wpm = round2(float64(1200 * time.Millisecond) / dit)
+    if len(dahs) > 0 {
+        report.DahDitRatio = round2(mean(dahs) / dit)
+    }
+    report.Dits = compareTiming(dits, dit, 1)
+    report.Dahs = compareTiming(dahs, dit, 3)
+
+    var elementSpaces, characterSpaces, wordSpaces []float64
+    elementSpaces, characterSpaces, wordSpaces, report.Pauses = classifySpaces(spaces, dit)
+    report.ElementSpaces = compareTiming(elementSpaces, dit, 1)
+    report.CharacterSpaces = compareTiming(characterSpaces, dit, 3)
+    report.WordSpaces = compareTiming(wordSpaces, dit, 7)
+
+    report.Trend = speedTrend(marks, markStarts, threshold)
+    report.TrendWpmPerMinute = trendSlope(report.Trend)
+
+    spread := (report.Dits.SpreadPercent + report.Dahs.SpreadPercent + report.ElementSpaces.SpreadPercent) / 300
+    report.Consistency = math.Round(math.Max(0, 100 - 200 * spread))
+
+    report.Text = strings.TrimSpace(decodeEdges(edges, events[0].Received, int(report.Wpm + 0.5)))
+    return report, nil
+}
+
+
+
+/**
+ * Sort spaces by their length in dits: under 2 dits are element spaces,
+ * under 5 character spaces and up to pauseDits word spaces.  Longer ones
+ * are pauses in the sending and are only counted.
+ */
+func classifySpaces(spaces []time.Duration, dit float64) (element, character, word []float64, pauses int) {
+    for _, space := range spaces {
+        length := float64(space) / dit
+        switch {
+        case length < 2:
+            element = append(element, float64(space))
+        case length < 5:
+            character = append(character, float64(space))
+        case length <= pauseDits:
+            word = append(word, float64(space))
+        default:
+            pauses++
+        }
+    }
+    return
+}
+
+
+
+/**
+ * The mark length that divides dits from dahs: two means found in the
+ * logarithms of the lengths, so a few long dahs do not pull it up.
+ * Marks all about the same length are taken to be dits.  Every mark
+ * must be longer than 0.
+ */
+func markThreshold(marks []time.Duration) time.Duration {
+    shortest, longest := marks[0], marks[0]
+    for _, mark := range marks {
+        if mark < shortest {
+            shortest = mark
+        }
+        if mark > longest {
+            longest = mark
+        }
+    }
+    if float64(longest) < singleLength * float64(shortest) {
+        return longest + 1
+    }
+
+    low, high := math.Log(float64(shortest)), math.Log(float64(longest))
+    for n := 0; n < 20; n++ {
+        middle := (low + high) / 2
+        var lows, highs []float64
+        for _, mark := range marks {
+            if math.Log(float64(mark)) < middle {
+                lows = append(lows, math.Log(float64(mark)))
+            } else {
+                highs = append(highs, math.Log(float64(mark)))
+            }
+        }
+        low, high = mean(lows), mean(highs)
+    }
+    return time.Duration(math.Exp((low + high) / 2))
+}
+
+
+
+// how some lengths compare with an ideal number of dits
+func compareTiming(lengths []float64, dit float64, ideal float64) timingStats {
+    stats := timingStats{Count: len(lengths), IdealDits: ideal}
+    if 0 == len(lengths) {
+        return stats
+    }
+    var misses, squares float64
+    m := mean(lengths)
+    for _, length := range lengths {
+        misses += math.Abs(length / dit - ideal) / ideal
+        squares += (length - m) * (length - m)
+    }
+    stats.MeanDits = round2(m / dit)
+    stats.ErrorPercent = round2(100 * misses / float64(len(lengths)))
+    stats.SpreadPercent = round2(100 * math.Sqrt(squares / float64(len(lengths))) / m)
+    return stats
+}
+
+
+
+/**
+ * The speed over each run of trendMarks marks, from the mean dit in it.
+ */
+func speedTrend(marks []time.Duration, starts []time.Duration, threshold time.Duration) []trendPoint {
+    var trend []trendPoint
+    for from := 0; from + trendMarks <= len(marks); from += trendMarks {
+        var dits []float64
+        for _, mark := range marks[from:from + trendMarks] {
+            if mark < threshold {
+                dits = append(dits, float64(mark))
+            }
+        }
+        if 0 == len(dits) {
+            continue
+        }
+        trend = append(trend, trendPoint{
+            Minute: round2(starts[from].Minutes()),
+            Wpm:    round2(float64(1200 * time.Millisecond) / mean(dits)),
+        })
+    }
+    return trend
+}
+
+
+
+// the least squares change in speed per minute, 0 with fewer than two points
+func trendSlope(trend []trendPoint) float64 {
+    if len(trend) < 2 {
+        return 0
+    }
+    var sx, sy, sxx, sxy float64
+    for _, p := range trend {
+        sx += p.Minute
+        sy += p.Wpm
+        sxx += p.Minute * p.Minute
+        sxy += p.Minute * p.Wpm
+    }
+    n := float64(len(trend))
+    if 0 == n * sxx - sx * sx {
+        return 0
+    }
+    return round2((n * sxy - sx * sy) / (n * sxx - sx * sx))
+}
+
+
+
+/**
+ * Print the report for a person to read.
+ */
+func (r *fistReport) print() {
+    fmt.Printf("Sender %s\n", r.Sender)
+    fmt.Printf("  copied:           %s\n", r.Text)
+    fmt.Printf("  speed:            %.1f WPM (dit %.0f ms)\n", r.Wpm, r.DitMs)
+    fmt.Printf("  dah:dit ratio:    %.2f (ideal 3)\n", r.DahDitRatio)
+    fmt.Println("                     count  mean  ideal  error  spread (dits)")
+    for _, row := range []struct {
+        name    string
+        stats   timingStats
+    }{
+        {"dits", r.Dits},
+        {"dahs", r.Dahs},
+        {"element spaces", r.ElementSpaces},
+        {"character spaces", r.CharacterSpaces},
+        {"word spaces", r.WordSpaces},
+    } {
+        fmt.Printf("  %-18s %5d %5.2f %5.0f %5.0f%% %6.0f%%\n", row.name, row.stats.Count,
+                   row.stats.MeanDits, row.stats.IdealDits, row.stats.ErrorPercent, row.stats.SpreadPercent)
+    }
+    if r.Pauses > 0 {
+        fmt.Printf("  pauses:           %d\n", r.Pauses)
+    }
+    if len(r.Trend) > 1 {
+        fmt.Printf("  speed trend:      %+.2f WPM per minute over %d stretches\n", r.TrendWpmPerMinute, len(r.Trend))
+    }
+    fmt.Printf("  consistency:      %.0f / 100\n", r.Consistency)
+}
+
+
+
+// the mean of some values, 0 for none
+func mean(values []float64) float64 {
+    if 0 == len(values) {
+        return 0
+    }
+    var sum float64
+    for _, v := range values {
+        sum += v
+    }
+    return sum / float64(len(values))
+}
+
+
+
+// a value to two decimal places, for reports
+func round2(v float64) float64 {
+    return math.Round(v * 100) / 100
+}
+
+/* end of file */
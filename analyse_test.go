@@ -0,0 +1,214 @@
+package main
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+
+
+/**
+ * Key some text perfectly, with dahs 'ratio' dits long.
+ *
+ * @param   text    what to send
+ * @param   wpm     sending speed
+ * @param   ratio   dah length in dits
+ * @return  []sessionEvent  the key events from sender "0001"
+ */
+func fistSession(t *testing.T, text string, wpm int, ratio float64) []sessionEvent {
+    elements, err := encodeMorse(text)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dit := wpmToDit(wpm)
+    at := time.Unix(1000, 0)
+    var events []sessionEvent
+    keyed := func(down bool) {
+        events = append(events, sessionEvent{Received: at, Sender: "0001", Down: down,
+                                             SentUs: at.UnixNano() / int64(time.Microsecond)})
+    }
+    for _, element := range elements {
+        switch element {
+        case '.':
+            keyed(true)
+            at = at.Add(dit)
+            keyed(false)
+        case '-':
+            keyed(true)
+            at = at.Add(time.Duration(ratio * float64(dit)))
+            keyed(false)
+        case ' ':
+            at = at.Add(dit)
+        }
+        at = at.Add(dit)
+    }
+    return events
+}
+
+
+
+func TestAnalyseFistMeasuresPerfectSending(t *testing.T) {
+    for _, test := range []struct {
+        text    string
+        wpm     int
+        ratio   float64
+    }{
+        {"PARIS PARIS PARIS", 20, 3},
+        {"CQ CQ DE NI7E", 15, 3},
+        {"THE QUICK BROWN FOX", 25, 4},
+        {"TEST DE NI7E", 12, 2.5},
+    } {
+        report, err := analyseFist("0001", fistSession(t, test.text, test.wpm, test.ratio))
+        if err != nil {
+            t.Errorf("%q: %v", test.text, err)
+            continue
+        }
+        if report.Text != test.text {
+            t.Errorf("%q: copied %q", test.text, report.Text)
+        }
+        if report.Wpm != float64(test.wpm) {
+            t.Errorf("%q: %v WPM, want %d", test.text, report.Wpm, test.wpm)
+        }
+        if report.DahDitRatio != test.ratio {
+            t.Errorf("%q: dah:dit ratio %v, want %v", test.text, report.DahDitRatio, test.ratio)
+        }
+        if report.Dits.ErrorPercent != 0 || report.ElementSpaces.ErrorPercent != 0 ||
+           report.CharacterSpaces.ErrorPercent != 0 || report.WordSpaces.ErrorPercent != 0 {
+            t.Errorf("%q: timing errors in perfect sending: %+v", test.text, report)
+        }
+        if report.Consistency != 100 {
+            t.Errorf("%q: consistency %v, want 100", test.text, report.Consistency)
+        }
+    }
+}
+
+
+
+func TestAnalyseFistAtTwentyWpmParis(t *testing.T) {
+    report, err := analyseFist("0001", fistSession(t, "PARIS PARIS", 20, 3))
+    if err != nil {
+        t.Fatal(err)
+    }
+    // PARIS is 10 dits, 4 dahs, 9 element spaces and 4 character spaces
+    if report.DitMs != 60 || report.Dits.Count != 20 || report.Dahs.Count != 8 ||
+       report.ElementSpaces.Count != 18 || report.CharacterSpaces.Count != 8 || report.WordSpaces.Count != 1 {
+        t.Errorf("counted %+v", report)
+    }
+    if report.WordSpaces.MeanDits != 7 || report.Dahs.MeanDits != 3 {
+        t.Errorf("word spaces %v dits and dahs %v dits, want 7 and 3",
+                 report.WordSpaces.MeanDits, report.Dahs.MeanDits)
+    }
+}
+
+
+
+func TestAnalyseFistRejectsClocksThatStallOrGoBack(t *testing.T) {
+    base := time.Unix(1000, 0)
+    event := func(down bool, us int64) sessionEvent {
+        return sessionEvent{Received: base, Sender: "0001", Down: down, SentUs: us}
+    }
+    for name, events := range map[string][]sessionEvent{
+        "zero length mark":     {event(true, 1000), event(false, 1000), event(true, 61000), event(false, 121000)},
+        "negative mark":        {event(true, 1000), event(false, 61000), event(true, 121000), event(false, 100000)},
+        "negative space":       {event(true, 1000), event(false, 61000), event(true, 30000), event(false, 90000)},
+        "no timestamps":        {event(true, 0), event(false, 0), event(true, 0), event(false, 0)},
+    } {
+        report, err := analyseFist("0001", events)
+        if err == nil {
+            t.Errorf("%s: analysed without an error", name)
+        }
+        if _, err := json.MarshalIndent(report, "", "  "); err != nil {
+            t.Errorf("%s: report cannot be written as JSON: %v", name, err)
+        }
+    }
+}
+
+
+
+func TestMarkThreshold(t *testing.T) {
+    ms := time.Millisecond
+    for _, test := range []struct {
+        name    string
+        marks   []time.Duration
+        low     time.Duration       // the threshold must be above this
+        high    time.Duration       // and no more than this
+    }{
+        {"dits and dahs", []time.Duration{60 * ms, 180 * ms, 60 * ms, 60 * ms, 180 * ms}, 60 * ms, 180 * ms},
+        {"uneven fist", []time.Duration{50 * ms, 70 * ms, 200 * ms, 160 * ms, 65 * ms}, 70 * ms, 160 * ms},
+        {"one long dah", []time.Duration{60 * ms, 60 * ms, 60 * ms, 60 * ms, 400 * ms}, 60 * ms, 400 * ms},
+        {"all dits", []time.Duration{60 * ms, 70 * ms, 55 * ms}, 70 * ms, 71 * ms},
+    } {
+        threshold := markThreshold(test.marks)
+        if threshold <= test.low || threshold > test.high {
+            t.Errorf("%s: threshold %v, want over %v and up to %v", test.name, threshold, test.low, test.high)
+        }
+    }
+}
+
+
+
+func TestCompareTiming(t *testing.T) {
+    for _, test := range []struct {
+        name    string
+        lengths []float64
+        ideal   float64
+        want    timingStats
+    }{
+        {"none", nil, 3, timingStats{IdealDits: 3}},
+        {"exact", []float64{180, 180}, 3, timingStats{Count: 2, MeanDits: 3, IdealDits: 3}},
+        {"long", []float64{240, 240}, 3, timingStats{Count: 2, MeanDits: 4, IdealDits: 3, ErrorPercent: 33.33}},
+        {"spread", []float64{50, 70}, 1, timingStats{Count: 2, MeanDits: 1, IdealDits: 1, ErrorPercent: 16.67,
+                                                      SpreadPercent: 16.67}},
+    } {
+        if got := compareTiming(test.lengths, 60, test.ideal); got != test.want {
+            t.Errorf("%s: %+v, want %+v", test.name, got, test.want)
+        }
+    }
+}
+
+
+
+func TestClassifySpaces(t *testing.T) {
+    ms := time.Millisecond
+    spaces := []time.Duration{60 * ms, 100 * ms, 180 * ms, 290 * ms, 420 * ms, 600 * ms, 601 * ms, 5 * time.Second}
+    element, character, word, pauses := classifySpaces(spaces, float64(60 * ms))
+    if len(element) != 2 || len(character) != 2 || len(word) != 2 || pauses != 2 {
+        t.Errorf("classified %d element, %d character and %d word spaces and %d pauses, want 2 of each",
+                 len(element), len(character), len(word), pauses)
+    }
+}
+
+
+
+func TestSpeedTrendAndSlope(t *testing.T) {
+    // dits slowing from 20 WPM to 15 WPM over three minutes
+    var marks, starts []time.Duration
+    for point, dit := range []time.Duration{60, 65, 72, 80} {
+        for n := 0; n < trendMarks; n++ {
+            marks = append(marks, dit * time.Millisecond)
+            starts = append(starts, time.Duration(point) * time.Minute + time.Duration(n) * time.Second)
+        }
+    }
+    trend := speedTrend(marks, starts, 150 * time.Millisecond)
+    want := []float64{20, 18.46, 16.67, 15}
+    if len(trend) != len(want) {
+        t.Fatalf("trend %v, want %d points", trend, len(want))
+    }
+    for i, point := range trend {
+        if point.Minute != float64(i) || point.Wpm != want[i] {
+            t.Errorf("point %d is %+v, want minute %d at %v WPM", i, point, i, want[i])
+        }
+    }
+    if slope := trendSlope(trend); slope != -1.68 {
+        t.Errorf("slope %v WPM per minute, want -1.68", slope)
+    }
+
+    for _, flat := range [][]trendPoint{nil, {{0, 20}}, {{1, 20}, {1, 25}}} {
+        if slope := trendSlope(flat); slope != 0 {
+            t.Errorf("slope of %v is %v, want 0", flat, slope)
+        }
+    }
+}
+
+/* end of file */
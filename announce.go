@@ -0,0 +1,76 @@
+package main
+
+import (
+    "time"
+)
+
+
+
+// event played at start up so a headless telegraph can be found
+const EV_ANNOUNCE = "announce"
+
+// how long the key must be held down to hear the announcement again
+const announceHold = 10 * time.Second
+
+// how long after start up a held key asks for the announcement
+const announceWindow = 2 * time.Minute
+
+
+
+/**
+ * Spots the key being held down long enough to ask for the
+ * announcement again.
+ *
+ * Only a hold that starts before 'until' counts.  The held key is sent
+ * to the channel like any other keying, so the hold is limited to the
+ * minutes after start up, when the operator is setting the telegraph up
+ * rather than sending.
+ */
+type keyHold struct {
+    hold    time.Duration
+    until   time.Time
+    downAt  time.Time
+}
+
+
+
+/**
+ * Record the key going down.
+ *
+ * @param   at      when it happened
+ */
+func (kh *keyHold) keyDown(at time.Time) {
+    if at.Before(kh.until) {
+        kh.downAt = at
+    }
+}
+
+
+
+/**
+ * Record the key coming up.
+ *
+ * @param   at      when it happened
+ * @return  bool    true if the key had been held down for long enough
+ */
+func (kh *keyHold) keyUp(at time.Time) bool {
+    held := !kh.downAt.IsZero() && at.Sub(kh.downAt) >= kh.hold
+    kh.downAt = time.Time{}
+    return held
+}
+
+
+
+/**
+ * Play the announcement with the current IP address.  The channel
+ * value is kept up to date by the socket client.
+ *
+ * @param   signals the status signaller
+ */
+func announce(signals *statusSignaller) {
+    signals.setValue("ip", localAddress())
+    signals.setValue("version", buildVersion)
+    signals.signal(EV_ANNOUNCE)
+}
+
+/* end of file */
@@ -0,0 +1,155 @@
+package main
+
+import (
+    "math"
+    "math/rand"
+    "time"
+)
+
+
+
+// band condition timing
+const(
+    qsbDefaultPeriod    = 8.0                       // seconds for one fade, if not set
+    qrmDefaultCarriers  = 2                         // interfering carriers, if not set
+    qrmShortest         = 40 * time.Millisecond     // shortest an interfering carrier is on or off
+    qrmLongest          = 400 * time.Millisecond    // longest an interfering carrier is on or off
+    qrmSpreadHz         = 400.0                     // interference lands this far either side of the pitch
+    )
+
+
+
+/**
+ * Simulated band conditions for one channel, read from the "band"
+ * section of the audio config.  Every intensity runs from 0, off, to 1.
+ */
+type BandConditions struct {
+    Noise       float64 `json:"noise"`          // level of band hiss
+    Qsb         float64 `json:"qsb"`            // depth of the slow fading of remote stations
+    QsbPeriodSec float64 `json:"qsbPeriodSec"` // time for one fade
+    Qrm         float64 `json:"qrm"`            // level of the interfering carriers
+    QrmCarriers int     `json:"qrmCarriers"`    // how many there are
+    JitterMs    float64 `json:"jitterMs"`       // most a remote key event is moved either way
+}
+
+
+
+/**
+ * The receive path effects: hiss and interference added to the audio,
+ * and fading applied to remote stations.  The local side tone is never
+ * faded.  Timing jitter is applied where remote key events are queued,
+ * through jitter().
+ */
+type bandEffects struct {
+    conditions  BandConditions
+    sampleRate  float64
+    random      *rand.Rand
+    rampLength  int
+    samples     int             // rendered so far, the clock for the fading
+    hiss        float64         // filtered noise
+    qrm         []qrmCarrier
+}
+
+
+
+// an interfering carrier keyed on and off at random
+type qrmCarrier struct {
+    step        float64         // phase change per sample, in radians
+    phase       float64
+    keyIsDown   bool
+    remaining   int             // samples until it is keyed again
+    ramp        int             // samples into the rise, 0 is silent
+}
+
+
+
+/**
+ * Create the effects for some band conditions.
+ *
+ * @param   conditions  the intensities
+ * @param   config      audio settings, for the pitch and sample rate
+ * @param   rampLength  samples in a key down or key up envelope
+ * @return  b           the effects
+ */
+func newBandEffects(conditions BandConditions, config AudioConfig, rampLength int) *bandEffects {
+    if conditions.QsbPeriodSec <= 0 {
+        conditions.QsbPeriodSec = qsbDefaultPeriod
+    }
+    if conditions.QrmCarriers <= 0 {
+        conditions.QrmCarriers = qrmDefaultCarriers
+    }
+    b := &bandEffects{
+        conditions: conditions,
+        sampleRate: float64(config.SampleRate),
+        random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+        rampLength: rampLength,
+    }
+    if conditions.Qrm > 0 {
+        for n := 0; n < conditions.QrmCarriers; n++ {
+            hz := config.PitchHz + qrmSpreadHz * (2 * b.random.Float64() - 1)
+            b.qrm = append(b.qrm, qrmCarrier{step: 2 * math.Pi * hz / b.sampleRate})
+        }
+    }
+    return b
+}
+
+
+
+/**
+ * Move on one sample.
+ *
+ * @return  fade    gain for remote stations
+ * @return  added   noise and interference to add to the sample
+ */
+func (b *bandEffects) next() (float64, float64) {
+    seconds := float64(b.samples) / b.sampleRate
+    b.samples++
+
+    // two slow waves that drift in and out of step, so no two fades are alike
+    period := b.conditions.QsbPeriodSec
+    fading := 0.5 - 0.25 * math.Cos(2 * math.Pi * seconds / period) - 0.25 * math.Cos(2 * math.Pi * seconds / (period * 1.618))
+    fade := 1 - clampLevel(b.conditions.Qsb) * fading
+
+    b.hiss += 0.3 * ((2 * b.random.Float64() - 1) - b.hiss)     // soften white noise into hiss
+    added := 2 * clampLevel(b.conditions.Noise) * b.hiss
+
+    for i := range b.qrm {
+        c := &b.qrm[i]
+        if c.remaining <= 0 {
+            c.keyIsDown = !c.keyIsDown
+            length := qrmShortest + time.Duration(b.random.Int63n(int64(qrmLongest - qrmShortest)))
+            c.remaining = int(length.Seconds() * b.sampleRate)
+        }
+        c.remaining--
+        if c.keyIsDown && c.ramp < b.rampLength {
+            c.ramp++
+        } else if !c.keyIsDown && c.ramp > 0 {
+            c.ramp--
+        }
+        envelope := 0.5 - 0.5 * math.Cos(math.Pi * float64(c.ramp) / float64(b.rampLength))
+        added += clampLevel(b.conditions.Qrm) * envelope * math.Sin(c.phase) / float64(len(b.qrm))
+        c.phase = math.Mod(c.phase + c.step, 2 * math.Pi)
+    }
+    return fade, added
+}
+
+
+
+/**
+ * A random timing error for one remote key event.
+ *
+ * @return  time.Duration   up to JitterMs either way
+ */
+func (b *bandEffects) jitter() time.Duration {
+    most := b.conditions.JitterMs * float64(time.Millisecond)
+    return time.Duration(most * (2 * b.random.Float64() - 1))
+}
+
+
+
+// an intensity held between 0 and 1
+func clampLevel(level float64) float64 {
+    return math.Max(0, math.Min(1, level))
+}
+
+/* end of file */
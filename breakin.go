@@ -0,0 +1,147 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+
+
+// how local and remote keying share the sounder
+const(
+    BK_BREAKIN      = "breakin"     // side tone while sending, remote muted until hang time ends
+    BK_SIDETONE     = "sidetone"    // only the local key and status signals drive the sounder
+    BK_MIXED        = "mixed"       // the sounder is on while anything is keying
+    )
+
+// things that want the sounder on
+const(
+    SRC_REMOTE      = iota          // keying received from the channel
+    SRC_LOCAL                       // side tone for the local key
+    SRC_STATUS                      // status signals and command replies
+    )
+
+
+
+/**
+ * Sounder sharing, read from the "breakIn" section of config.json.
+ */
+type BreakInConfig struct {
+    Policy  string  `json:"policy"`     // one of the BK_* policies
+    HangMs  int     `json:"hangMs"`     // remote stays muted this long after a local key up
+}
+
+
+
+func defaultBreakInConfig() BreakInConfig {
+    return BreakInConfig{Policy: BK_BREAKIN, HangMs: 0}
+}
+
+
+
+/**
+ * Decides whether the sounder is on from what each source asks for.
+ *
+ * The local key and status signals are always heard.  With the breakin
+ * policy remote keying is muted while the local key is down and for
+ * HangMs after it comes up; a hang time of 0 is full break-in, hearing
+ * the channel between the elements being sent.  A remote element that
+ * was cut off, or that started while muted, is not heard; the sounder
+ * follows the remote key again from its next key down so half elements
+ * are never played.
+ */
+type sounderArbiter struct {
+    mutex       sync.Mutex
+    config      BreakInConfig
+    wants       [3]bool         // latest request from each SRC_* source
+    hearing     bool            // the current remote element is being played
+    localUp     time.Time       // when the local key last came up
+}
+
+
+
+/**
+ * Create a sounder arbiter.
+ *
+ * @param   config  sharing policy
+ * @return  a       the sounder arbiter, with every source off
+ */
+func newSounderArbiter(config BreakInConfig) *sounderArbiter {
+    return &sounderArbiter{config: config}
+}
+
+
+
+/**
+ * Change the sharing policy.
+ */
+func (a *sounderArbiter) setConfig(config BreakInConfig) {
+    a.mutex.Lock()
+    a.config = config
+    a.mutex.Unlock()
+}
+
+
+
+/**
+ * Take a request from one source.
+ *
+ * @param   source  one of the SRC_* sources
+ * @param   on      true to ask for the sounder on
+ * @param   at      when the request was made
+ * @return  bool    true if the sounder should be on
+ */
+func (a *sounderArbiter) set(source int, on bool, at time.Time) bool {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    a.wants[source] = on
+    if SRC_LOCAL == source && !on {
+        a.localUp = at
+    }
+
+    hang := time.Duration(a.config.HangMs) * time.Millisecond
+    sending := a.wants[SRC_LOCAL] || (!a.localUp.IsZero() && at.Sub(a.localUp) < hang)
+
+    switch a.config.Policy {
+    case BK_MIXED:
+        a.hearing = a.wants[SRC_REMOTE]
+    case BK_SIDETONE:
+        a.hearing = false
+    default:
+        if !a.wants[SRC_REMOTE] || sending {
+            a.hearing = false
+        } else if SRC_REMOTE == source {
+            a.hearing = true                // a new remote key down while not sending
+        }
+    }
+
+    return a.wants[SRC_LOCAL] || a.wants[SRC_STATUS] || a.hearing
+}
+
+
+
+/**
+ * Report whether the remote keying is being played under the policy.
+ */
+func (a *sounderArbiter) hearingRemote() bool {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+    return a.hearing
+}
+
+
+
+/**
+ * Report whether a source is asking for the sounder on, whatever the
+ * policy says.
+ *
+ * @param   source  one of the SRC_* sources
+ */
+func (a *sounderArbiter) wanted(source int) bool {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+    return a.wants[source]
+}
+
+/* end of file */
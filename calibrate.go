@@ -0,0 +1,187 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math"
+    "os"
+    "sort"
+    "time"
+
+    "github.com/stianeikeland/go-rpio"
+)
+
+
+
+// sounder calibration timing
+const(
+    calibrationCycles   = 10                        // pull in / release cycles measured
+    calibrationTimeout  = 250 * time.Millisecond    // longest a sounder may take to move
+    calibrationSettle   = 300 * time.Millisecond    // quiet time between edges
+    )
+
+
+
+/**
+ * Measure the pull in and release time of every output that has a
+ * sense input, and store them in the config file.
+ *
+ * The sense input is a contact closed to ground by the armature when it
+ * is pulled in.  Each output is pulled in and released
+ * calibrationCycles times and the median of each delay is kept.  The
+ * config file is rewritten with the new "outputs" list, keeping a copy
+ * of the old file with ".bak" added to its name.  With no config file
+ * the values are printed to be added by hand.  rpio must already be
+ * open.
+ *
+ * @param   config  configuration settings
+ * @param   path    config file to update, "" if there is none
+ * @return  error   set if nothing could be measured or saved
+ */
+func calibrateOutputs(config Config, path string) error {
+    outputs := append([]OutputConfig(nil), config.Outputs...)
+    measured := 0
+    for i, output := range outputs {
+        if 0 == output.SensePin {
+            continue
+        }
+        fmt.Println("Calibrating the output on BCM", output.Pin, "with the sense input on BCM", output.SensePin)
+        pullIn, release, err := measureSounder(output)
+        if err != nil {
+            return fmt.Errorf("outputs[%d]: %v", i, err)
+        }
+        outputs[i].PullInMs, outputs[i].ReleaseMs = pullIn, release
+        fmt.Println("pull in", pullIn, "ms, release", release, "ms")
+        measured++
+    }
+    if 0 == measured {
+        return errors.New("no output has a sensePin to calibrate with")
+    }
+
+    if path == "" {
+        encoded, _ := json.MarshalIndent(outputs, "  ", "  ")
+        fmt.Println("No config file; add this to config.json:")
+        fmt.Println("  \"outputs\": " + string(encoded))
+        return nil
+    }
+    return saveOutputs(path, outputs)
+}
+
+
+
+/**
+ * Time a sounder through its sense input.
+ *
+ * @param   output  the output and its sense input
+ * @return  float64 median pull in time in milliseconds
+ * @return  float64 median release time in milliseconds
+ * @return  error   set if the sense input did not follow the sounder
+ */
+func measureSounder(output OutputConfig) (float64, float64, error) {
+    drive := newGpioLED(output.Pin, output.ActiveLow)
+    sense := rpio.Pin(output.SensePin)
+    sense.Input()
+    sense.PullUp()
+    defer drive.set(false)
+
+    var pullIns, releases []time.Duration
+    drive.set(false)
+    time.Sleep(calibrationSettle)
+    for n := 0; n < calibrationCycles; n++ {
+        delay, err := timeEdge(drive, sense, true)
+        if err != nil {
+            return 0, 0, err
+        }
+        pullIns = append(pullIns, delay)
+        time.Sleep(calibrationSettle)
+
+        delay, err = timeEdge(drive, sense, false)
+        if err != nil {
+            return 0, 0, err
+        }
+        releases = append(releases, delay)
+        time.Sleep(calibrationSettle)
+    }
+    return medianMs(pullIns), medianMs(releases), nil
+}
+
+
+
+/**
+ * Drive an output and wait for the sense input to follow.
+ *
+ * @param   drive   the output
+ * @param   sense   the sense input, low while the armature is pulled in
+ * @param   on      true to pull the sounder in, false to release it
+ * @return  time.Duration   how long the sense input took to change
+ * @return  error   set if it was already in the new state or never got there
+ */
+func timeEdge(drive *gpioLED, sense rpio.Pin, on bool) (time.Duration, error) {
+    want := rpio.High
+    if on {
+        want = rpio.Low
+    }
+    if want == sense.Read() {
+        return 0, fmt.Errorf("sense input on BCM %d changed before the sounder was driven", sense)
+    }
+
+    start := time.Now()
+    drive.set(on)
+    for time.Since(start) < calibrationTimeout {
+        if want == sense.Read() {
+            return time.Since(start), nil
+        }
+    }
+    return 0, fmt.Errorf("sense input on BCM %d did not change within %v", sense, calibrationTimeout)
+}
+
+
+
+// the median of some delays in milliseconds, to a tenth of a millisecond
+func medianMs(delays []time.Duration) float64 {
+    sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+    median := delays[len(delays) / 2]
+    return math.Round(float64(median) / float64(time.Millisecond) * 10) / 10
+}
+
+
+
+/**
+ * Replace the "outputs" list in a config file, leaving the other keys as
+ * they are.
+ *
+ * @param   path    the config file
+ * @param   outputs the new outputs
+ * @return  error   set if the file could not be read or written
+ */
+func saveOutputs(path string, outputs []OutputConfig) error {
+    original, err := ioutil.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    var fields map[string]json.RawMessage
+    if err := json.Unmarshal(original, &fields); err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    fields["outputs"], _ = json.Marshal(outputs)
+    updated, err := json.MarshalIndent(fields, "", "  ")
+    if err != nil {
+        return err
+    }
+
+    if err := ioutil.WriteFile(path + ".bak", original, 0644); err != nil {
+        return err
+    }
+    if err := ioutil.WriteFile(path + ".tmp", append(updated, '\n'), 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(path + ".tmp", path); err != nil {
+        return err
+    }
+    fmt.Println("Saved the calibration to", path, "- the old file is", path + ".bak")
+    return nil
+}
+
+/* end of file */
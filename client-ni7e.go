@@ -1,11 +1,18 @@
 package main
 
 import (
-    "encoding/json"
     "fmt"
+    "flag"
+    "net"
     "os"
+    "os/signal"
+    "reflect"
     "bytes"
     "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
     "time"
 
     "github.com/stianeikeland/go-rpio"
@@ -15,15 +22,19 @@ import (
 
 
 const keyPinBCM     = 07    // keyPinNumber        = 26
-const spkrPinBCM    = 10    // spkrPinNumber       = 19 active high
-const spkrPinBCML   = 27    // spkrPinNumberL      = 13 active low
+const spkrPinBCM    = 10    // spkrPinNumber       = 19 active high, default output
+const spkrPinBCML   = 27    // spkrPinNumberL      = 13 active low, default output
 
 // operation constants
 const (
-        mainLoopMs      = 10
-        mainLoop1Sec    = 1000 / mainLoopMs
-        mainLoop5Sec    = mainLoop1Sec * 5
-        mainLoop30Sec   = mainLoop1Sec * 30
+        keyPollInterval         = 2 * time.Millisecond  // how often the Morse key is read, fine enough to time keyer elements
+        connectionCheckInterval = 100 * time.Millisecond
+        pingInterval            = 30 * time.Second
+        statsInterval           = 5 * time.Minute
+        decoderInterval         = 20 * time.Millisecond
+        indicatorInterval       = 20 * time.Millisecond
+        indicatorModeInterval   = 500 * time.Millisecond
+        dialTimeout             = 10 * time.Second      // well under the systemd WatchdogSec, dials run on the scheduler
     )
 
 
@@ -34,32 +45,31 @@ var (
     buildVersion    string
     toneState       tone
     key             morseKey
+    stats           clientStats
+    statusLight     *indicator
+    playbackWpm     int32       // speed of signals and replies, changed by QRS and QRQ
+    sounderLock     sync.Mutex  // one message at a time on the sounder
+    recorder        *sessionRecorder
 
 )
 
 
 
-// struction to hold application configuration information
-type Config struct {
-    Channel string
-    Server  string
-    Port    string
-    Gpio    bool
-}
-
-
-
 type morseKey struct {
-    state   string
-    keyPin  rpio.Pin
+    state       string
+    keyPin      rpio.Pin        // straight key or dit lever
+    dahPin      rpio.Pin        // dah lever
+    ditFilter   *contactFilter
+    dahFilter   *contactFilter
+    keyer       *keyer
 }
 
 
 
 type tone struct {
-    spkrPin     rpio.Pin    // active high
-    spkrPinL    rpio.Pin    // active low
+    outputs     *outputRouter
     command     rpio.State
+    arbiter     *sounderArbiter
 }
 
 
@@ -68,58 +78,22 @@ type socketClient struct {
     ip          string
     port        string
     channel     string
-    status      string
     url         string
-    redialCount int
+    servers     *serverPool
+    signals     *statusSignaller
+    reconnect   *reconnector
     conn        *websocket.Conn
 }
 
 
 
-const(
-    SC_NOT_STARTED  = "not started"
-    SC_DISCONNECTED = "disconnected"
-    SC_CONNECTED    = "connected"
-    SC_RECONNECTING = "reconnecting"
-    )
-
-
-
-/**
- * Reads configuration information from a file.
- *
- * The hardcoded file name 'config.json' is open and read to
- * populate the 'Config' data structure.  If reading or decoding
- * the file fails, the following default values are used:
- *      Channel = "lobby"
- *      Server  = "morse.autodidacts.io"
- *      Port    = "8000"
- *
- * @ return Config  structure containing application parameters
- */
-func getConfiguration() (Config) {
-
-    // allow for future feature of using an OS environment variable, for not, we hardcode it
-    os.Setenv("TELEGRAPH_CONFIG_PATH", "config.json")
-    file, _ := os.Open(os.Getenv("TELEGRAPH_CONFIG_PATH"))
-    decoder := json.NewDecoder(file)
-
-    // allow for future feature of using alternate input methods
-    // TODO remove Gpio from Config - it is no longer used
-    config  := Config{Gpio: true}
-
-    // read application configuration from the TELEGRAPH_CONFIG_PATH file
-    err     := decoder.Decode(&config)
-    if err != nil {
-        fmt.Println("Error reading config.json: ", err)
-        config.Channel  = "lobby"
-        config.Server   = "morse.autodidacts.io"
-        config.Port     = "8000"
-    }
-
-    fmt.Println("configuration: ", config)
-
-    return config
+// counters reported periodically by the stats task
+type clientStats struct {
+    sent        int64
+    received    int64
+    dials       int64
+    pings       int64
+    debounce    debounceStats
 }
 
 
@@ -153,17 +127,32 @@ func initializeRpio() int {
 
 
 
+/**
+ * Configure the input for the dah lever of a paddle, with its pull up
+ * enabled like the key pin.
+ *
+ * @parent  mk      this function is associated with the
+ *                  morseKey structure
+ * @param   bcm     BCM number of the dah lever input
+ */
+func (mk *morseKey) setDahPin(bcm int) {
+    mk.dahPin = rpio.Pin(bcm)
+    mk.dahPin.Input()
+    mk.dahPin.PullUp()
+}
+
+
+
 /**
  * Set the initial values for the tone state data structure.
  *
- * @param   ts  'tone' data structure to use
- * @return  ts  the updated 'tone' data structure
+ * @param   ts      'tone' data structure to use
+ * @param   config  configuration settings
+ * @return  ts      the updated 'tone' data structure
  */
-func intitializeToneState(ts tone) tone {
-    ts.spkrPin = rpio.Pin(spkrPinBCM)
-    ts.spkrPinL = rpio.Pin(spkrPinBCML)
-    ts.spkrPin.Output()
-    ts.spkrPinL.Output()
+func intitializeToneState(ts tone, config Config) tone {
+    ts.outputs  = newOutputRouter(config.Outputs, systemClock{})
+    ts.arbiter  = newSounderArbiter(config.BreakIn)
     ts.command  = rpio.Low      // turn off the tone
 
     return ts
@@ -175,15 +164,68 @@ func intitializeToneState(ts tone) tone {
  * Configure the network socket client library
  *
  * @param   config  configuration settings
+ * @param   signals status signaller told about connection events
  * @return  sc      socket client handle
  */
-func initializeSocketClient(config Config) socketClient {
+func initializeSocketClient(config Config, signals *statusSignaller) *socketClient {
     // Init socketClient & dial websocket
-    sc := socketClient{ ip: config.Server,
-                        port: config.Port,
-                        channel: config.Channel,
-                        status: SC_NOT_STARTED,
-                        redialCount: 0}
+    sc := &socketClient{signals: signals}
+    sc.reconnect = newReconnector(config.Reconnect, systemClock{}, sc.report)
+    sc.configure(config)
+    sc.servers.refresh()                // the scheduler is not running yet
+
+    return sc
+}
+
+
+
+/**
+ * Tell systemd and the user about a connection event.
+ *
+ * @parent  sc      this function is associated with the
+ *                  socketClient structure
+ * @param   event   one of the EV_* events
+ */
+func (sc *socketClient) report(event string) {
+    sdNotify("STATUS=" + event + " " + sc.servers.current().String())
+    sc.signals.signal(event)
+}
+
+
+
+/**
+ * Set the servers and channel to dial.  Takes effect on the next dial.
+ *
+ * @parent  sc      this function is associated with the
+ *                  socketClient structure
+ * @param   config  configuration settings
+ */
+func (sc *socketClient) configure(config Config) {
+    if sc.servers != nil {
+        sc.servers.retire()             // a failback check may still be probing it
+    }
+    sc.channel  = config.Channel
+    sc.servers  = newServerPool(config)
+    sc.signals.setValue("channel", sc.channel)
+    toneState.outputs.setChannel(sc.channel)
+    sc.useServer()
+}
+
+
+
+/**
+ * Dial the server the server pool says to use from now on.
+ *
+ * @parent  sc      this function is associated with the
+ *                  socketClient structure
+ */
+func (sc *socketClient) useServer() {
+    server      := sc.servers.current()
+    sc.ip       = server.Server
+    sc.port     = server.Port
+    sc.signals.setValue("server", server.Server)
+    sc.signals.setValue("n", strconv.Itoa(sc.servers.position()))
+
     var url bytes.Buffer
 
     url.WriteString("ws://")
@@ -194,8 +236,68 @@ func initializeSocketClient(config Config) socketClient {
     url.WriteString(sc.channel)
 
     sc.url  = url.String()
+    fmt.Println("Active server", sc.servers.position(), ":", server)
+}
 
-    return sc
+
+
+/**
+ * Move to a different server or channel.
+ *
+ * The current connection is closed first so nothing more is received
+ * from the old channel, then the sounder is turned off in case the
+ * switch happened in the middle of a remote key down.  The reconnect
+ * manager dials the new channel on its next check.
+ *
+ * @parent  sc      this function is associated with the
+ *                  socketClient structure
+ * @param   config  configuration with the new server and channel
+ * @param   c       the go communication channel
+ */
+func (sc *socketClient) retune(config Config, c chan rpio.State) {
+    fmt.Println("Switching from", sc.url)
+    sc.hangUp(c)
+    sc.configure(config)
+    go sc.servers.refresh()             // picked up by the next dial
+    fmt.Println("Switching to", sc.url)
+}
+
+
+
+/**
+ * Move back to a preferred server that checkFailback() found working.
+ * Nothing is done if the client was retuned to a new server pool since.
+ *
+ * @parent  sc      this function is associated with the
+ *                  socketClient structure
+ * @param   pool    the server pool that was checked
+ * @param   c       the go communication channel
+ */
+func (sc *socketClient) failback(pool *serverPool, c chan rpio.State) {
+    if pool != sc.servers {
+        return
+    }
+    sc.hangUp(c)
+    sc.useServer()
+    sc.report(EV_FAILBACK)
+}
+
+
+
+/**
+ * Drop the current connection with the sounder left off.
+ *
+ * @parent  sc      this function is associated with the
+ *                  socketClient structure
+ * @param   c       the go communication channel
+ */
+func (sc *socketClient) hangUp(c chan rpio.State) {
+    if sc.conn != nil {
+        sc.conn.Close()
+    }
+    sc.reconnect.lostCurrent()
+    c <- rpio.Low                               // sounder off while switching
+    statusLight.remoteKey(false)
 }
 
 
@@ -203,28 +305,80 @@ func initializeSocketClient(config Config) socketClient {
 /**
  * Connect to the internet-telegraph server
  *
+ * The outcome is reported to the reconnect manager, which starts a
+ * new listen goroutine for every successful connection.
+ *
  * @parent  sc      this function is associated with the
  *                  socketClient structure
  * @param   c       the go communication channel
  * @param   state   type of data in the channel
  */
-// TODO remove the channel as it is not being used anymore
 func (sc *socketClient) dial(c chan rpio.State) {
+    if server := sc.servers.current(); server.Server != sc.ip || server.Port != sc.port {
+        sc.useServer()                  // an SRV lookup changed the list
+    }
     fmt.Println("Dialing ",  sc.url)
+    atomic.AddInt64(&stats.dials, 1)
 
-    conn, err := websocket.Dial(sc.url, "", "http://localhost")
+    if sc.conn != nil {
+        sc.conn.Close()                 // make sure the old listener stops
+    }
+
+    sc.reconnect.dialing()
+    conn, err := dialWebsocket(sc.url, dialTimeout)
     if err == nil {
         sc.conn = conn
-        sc.status = SC_CONNECTED
-        fmt.Println("sc.status = " + sc.status)
         fmt.Print("sc.conn dial: ")
         fmt.Println(sc.conn)
-        // playMorse(".-. . .- -.. -.--", c)
-        // playMorse(".--. --- ... - ..... ----. ----.", c)
-        // playMorseElements(".--. --- ... - ..... ----. ----.", c)
+        sc.servers.dialSucceeded()
+        sc.reconnect.connected(func() error {
+            return sc.listen(conn, c)
+        })
     } else {
         fmt.Println("Error connecting to '" + sc.url + "': " + err.Error())
+        sc.reconnect.dialFailed()
+        if sc.servers.dialFailed() {
+            sc.useServer()
+            sc.report(EV_FAILOVER)
+            sc.reconnect.retryNow()             // try the new server straight away
+        }
+    }
+}
+
+
+
+/**
+ * Open a websocket, giving up if the connection and handshake take
+ * longer than 'timeout'.  A server, or a proxy in front of it, that does
+ * not answer would otherwise hold the scheduler long enough for the
+ * watchdog to restart the client.
+ *
+ * @param   url     the websocket URL
+ * @param   timeout the longest to wait
+ * @return  conn    the connection
+ * @return  error   set if the server could not be reached in time
+ */
+func dialWebsocket(url string, timeout time.Duration) (*websocket.Conn, error) {
+    config, err := websocket.NewConfig(url, "http://localhost")
+    if err != nil {
+        return nil, err
+    }
+    address := config.Location.Host
+    if config.Location.Port() == "" {
+        address = net.JoinHostPort(config.Location.Hostname(), "80")
+    }
+    tcp, err := net.DialTimeout("tcp", address, timeout)
+    if err != nil {
+        return nil, err
+    }
+    tcp.SetDeadline(time.Now().Add(timeout))
+    conn, err := websocket.NewClient(config, tcp)
+    if err != nil {
+        tcp.Close()
+        return nil, err
     }
+    tcp.SetDeadline(time.Time{})                // the listener waits as long as it likes
+    return conn, nil
 }
 
 
@@ -232,8 +386,8 @@ func (sc *socketClient) dial(c chan rpio.State) {
 /**
  * Send a string to the internet-telegraph server
  *
- * If sending fails, update the status to allow the caller
- * to attempt a reconnect if desired.
+ * If sending fails, report the connection lost so the
+ * reconnect manager redials it.
  *
  * @parent  sc      this function is associated wi the
  *                  socketClient structure
@@ -246,12 +400,15 @@ func (sc *socketClient) dial(c chan rpio.State) {
      if sc.conn != nil {
 
          sendErr := websocket.Message.Send(sc.conn, msg)
-         if sendErr != nil {
-             sc.status = SC_DISCONNECTED
+         if sendErr == nil {
+             atomic.AddInt64(&stats.sent, 1)
+         } else {
              fmt.Print("sc.conn send: ")
              fmt.Println(sc.conn)
              fmt.Println("Could not send message:")
              fmt.Println(sendErr.Error())
+             sc.conn.Close()
+             sc.reconnect.lostCurrent()
          }
      } else {
          fmt.Println("Network error: sc.conn NOT initialized")
@@ -267,36 +424,47 @@ func (sc *socketClient) dial(c chan rpio.State) {
  * once started, the routine continues to run without needing to be
  * called by the main loop.
  *
+ * One listen goroutine runs per connection.  It is started by the
+ * reconnect manager and returns when the connection fails, which tells
+ * the reconnect manager the connection has been lost.
+ *
  * @parent  sc      this function is associated wi the
  *                  socketClient structure
+ * @param   conn    the connection to listen on
  * @param   c       the go communication channel
  * @param   state   type of data in the channel
+ * @return  error   the reason the connection stopped
  */
-func (sc *socketClient) listen(c chan rpio.State) {
+func (sc *socketClient) listen(conn *websocket.Conn, c chan rpio.State) error {
     fmt.Println("Client listening...")
     var msg string
-    for sc.status == SC_CONNECTED {
-        err := websocket.Message.Receive(sc.conn, &msg)
-        if err == nil {
-            // message received - process it
-            fmt.Println("received from server: ", msg, "msg[:1]: ", msg[:1])
-            fmt.Println("---------------")
-            // TODO use key down count to allow logical ORing of multiple keys
-            if msg[:1] == "0" {
-                c <- rpio.Low
-            } else if msg[:1] == "1" {
-                c <- rpio.High
-            } else {
-                // do nothing
-            }
-
-            // sc.onMessage(msg)
-        } else if 2 > sc.redialCount {
-            sc.status = SC_DISCONNECTED
+    for {
+        err := websocket.Message.Receive(conn, &msg)
+        if err != nil {
             fmt.Println("Websocket error on Message.Receive(): " + err.Error())
+            return err
+        }
+
+        // message received - process it
+        atomic.AddInt64(&stats.received, 1)
+        fmt.Println("received from server: ", msg, "msg[:1]: ", msg[:1])
+        if len(msg) > 5 {
+            sent := messageSentUs(msg[:len(msg) - 4])
+            recorder.record(sessionEvent{Received: time.Now(), Channel: sc.channel,
+                                         Sender: msg[len(msg) - 4:], Down: msg[:1] == "1", SentUs: sent})
+        }
+        fmt.Println("---------------")
+        // TODO use key down count to allow logical ORing of multiple keys
+        if msg[:1] == "0" {
+            statusLight.remoteKey(false)
+            c <- rpio.Low
+        } else if msg[:1] == "1" {
+            statusLight.remoteKey(true)
+            c <- rpio.High
+        } else {
+            // do nothing
         }
     }
-    fmt.Println("FATAL ERROR: socket client not connected!")
 }
 
 
@@ -308,29 +476,55 @@ func (sc *socketClient) listen(c chan rpio.State) {
  * once started, the routine continues to run without needing to be
  * called by the main loop.
  *
+ * Remote keying, the local side tone and status signals each have
+ * their own channel.  The sounder arbiter decides from all three
+ * whether the sounder is on, so they do not fight over the pins, and
+ * the output router sets each output pin from its own source.
+ *
  * @parent  t       this function is associated wi the
  *                  tone structure
- * @param   c       the go communication channel
- * @param   state   type of data in the channel
+ * @param   remote  keying received from the channel
+ * @param   local   side tone for the local key
+ * @param   status  status signals and command replies
  */
-func (t *tone) control(c chan rpio.State) {
+func (t *tone) control(remote, local, status chan rpio.State) {
     // TODO add timeout to key down messages from server
     // TOOD allow local key down to run forever ???
-    var command rpio.State
+    var (
+            command     rpio.State
+            source      int
+        )
     for {
-        command = <-c
-        t.spkrPin.Write(command)
-        if command == rpio.High {
-            t.spkrPinL.Write(rpio.Low)
-        } else {
-            t.spkrPinL.Write(rpio.High)
+        select {
+        case command = <-remote:
+            source = SRC_REMOTE
+        case command = <-local:
+            source = SRC_LOCAL
+        case command = <-status:
+            source = SRC_STATUS
         }
+        now := time.Now()
+        t.arbiter.set(source, rpio.High == command, now)
+        t.outputs.update(t.arbiter, now)
     }
 }
 
 
 
 
+/**
+ * Turn the sounder off and leave it off.  Used at shutdown so the
+ * sounder is not left pulled in.
+ *
+ * @parent  t       this function is associated wi the
+ *                  tone structure
+ */
+func (t *tone) release() {
+    t.outputs.release()
+}
+
+
+
 /**
  * Goroutine to time the sounding of 'dit', 'dah', and space characters.
  *
@@ -342,15 +536,14 @@ func (t *tone) control(c chan rpio.State) {
  * @param   state   type of data in the channel
  */
 func playMorseElements(message string, c chan rpio.State) {
-    // TODO allow config.json file to configure the speed
     // TODO allow optional interruption of message
     var (
             sound           rpio.State
             elementLength   time.Duration
         )
-    const WPM20 = 1200/20   // at 20 WPM a dit is 60 ms
-    const WPM13 = 1200/13   // at 13 WPM a dit is 92 ms
-    ditTime := time.Duration(WPM13) * time.Millisecond
+    ditTime := playbackDitTime()
+    sounderLock.Lock()
+    defer sounderLock.Unlock()
 
     for i := 0; i < len(message); i++ {
         sound           = rpio.High
@@ -376,6 +569,15 @@ func playMorseElements(message string, c chan rpio.State) {
 
 
 
+/**
+ * Length of a dit at the playback speed.
+ */
+func playbackDitTime() time.Duration {
+    return wpmToDit(int(atomic.LoadInt32(&playbackWpm)))
+}
+
+
+
 // TODO repurpose this to encode strings into Morse code.
 func playMorse(message string, c chan rpio.State) {
     // TODO allow config.json file to configure the speed
@@ -402,6 +604,189 @@ func playMorse(message string, c chan rpio.State) {
 
 
 
+/**
+ * Scheduler task that redials the server when the reconnect manager
+ * says an attempt is due.
+ *
+ * @parent  sc      this function is associated with the
+ *                  socketClient structure
+ * @param   c       the go communication channel
+ */
+func (sc *socketClient) checkConnection(c chan rpio.State) {
+    if sc.reconnect.due() {
+        sc.dial(c)
+    }
+}
+
+
+
+/**
+ * Apply a reloaded configuration while running.
+ *
+ * A new server or channel is redialled; redial timing, status signals,
+ * the indicator LED, playback speed, keyed commands, the keyer, key
+ * debouncing, break-in and output pins are changed in place.
+ *
+ * @param   old     the configuration in use
+ * @param   new     the configuration to change to
+ * @param   sc      the server connection
+ * @param   signals the status signaller
+ * @param   commands the keyed command interpreter
+ * @param   c       the go communication channel
+ */
+func applyConfiguration(old, new Config, sc *socketClient, signals *statusSignaller,
+                        commands *commandInterpreter, c chan rpio.State) {
+    if old.Server != new.Server || old.Port != new.Port || old.Channel != new.Channel ||
+       old.ServerSrv != new.ServerSrv || old.Failover != new.Failover ||
+       !reflect.DeepEqual(old.Servers, new.Servers) {
+        sc.retune(new, c)
+    }
+    if old.Reconnect != new.Reconnect {
+        sc.reconnect.setConfig(new.Reconnect)
+    }
+    if !reflect.DeepEqual(old.Signals, new.Signals) {
+        signals.setSignals(defaultSignals, new.Signals)
+    }
+    if old.Indicator != new.Indicator {
+        statusLight.setBackend(newLEDBackend(new.Indicator))
+    }
+    if old.PlaybackWpm != new.PlaybackWpm {
+        atomic.StoreInt32(&playbackWpm, int32(new.PlaybackWpm))
+    }
+    if old.Commands != new.Commands {
+        commands.setConfig(new.Commands)
+    }
+    if old.Keyer != new.Keyer {
+        paddle, wasPaddle := KM_STRAIGHT != new.Keyer.Mode, KM_STRAIGHT != old.Keyer.Mode
+        pinMoved := old.Keyer.DahPin != new.Keyer.DahPin
+        if paddle && (!wasPaddle || pinMoved) {
+            key.setDahPin(new.Keyer.DahPin)
+        }
+        key.keyer.setConfig(new.Keyer)
+        if wasPaddle && (!paddle || pinMoved) {
+            toneState.outputs.setOutputs(new.Outputs)   // an output may use the old dah pin
+        }
+    }
+    if old.Recorder != new.Recorder {
+        if err := recorder.setConfig(new.Recorder); err != nil {
+            fmt.Println("session log:", err)
+        }
+    }
+    if !reflect.DeepEqual(old.Outputs, new.Outputs) {
+        toneState.outputs.setOutputs(new.Outputs)
+    }
+    if old.BreakIn != new.BreakIn {
+        toneState.arbiter.setConfig(new.BreakIn)
+    }
+    if old.Debounce != new.Debounce {
+        key.ditFilter.setConfig(new.Debounce)
+        key.dahFilter.setConfig(new.Debounce)
+    }
+}
+
+
+
+/**
+ * Carry out a command keyed by the operator.
+ *
+ *      QSY <channel>   change to another channel until the configuration
+ *                      is next reloaded
+ *      QRS, QRQ        play signals and replies slower or faster
+ *      IP?             send back the telegraph's IP address
+ *      VER?            send back the client version
+ *
+ * @param   words   the command, split into words
+ * @param   reloader holds the configuration in use
+ * @param   sc      the server connection
+ * @param   signals the status signaller
+ * @param   commands the keyed command interpreter
+ * @param   c       the go communication channel
+ * @return  string  the reply, "?" if the command was not understood
+ */
+func runCommand(words []string, reloader *configReloader, sc *socketClient, signals *statusSignaller,
+                commands *commandInterpreter, c chan rpio.State) string {
+    switch words[0] {
+    case "QSY":
+        if len(words) != 2 {
+            return "?"
+        }
+        new := reloader.current
+        new.Channel = strings.ToLower(words[1])
+        if err := new.validate(); err != nil {
+            fmt.Println("QSY:", err)
+            return "?"
+        }
+        old := reloader.current
+        reloader.current = new
+        applyConfiguration(old, new, sc, signals, commands, c)
+        return "R"
+
+    case "QRS", "QRQ":
+        wpm := int(atomic.LoadInt32(&playbackWpm))
+        if "QRS" == words[0] {
+            wpm -= playbackWpmStep
+        } else {
+            wpm += playbackWpmStep
+        }
+        if wpm < minPlaybackWpm {
+            wpm = minPlaybackWpm
+        }
+        if wpm > maxPlaybackWpm {
+            wpm = maxPlaybackWpm
+        }
+        atomic.StoreInt32(&playbackWpm, int32(wpm))
+        fmt.Println("playback speed", wpm, "WPM")
+        return strconv.Itoa(wpm)
+
+    case "IP?", "IP":
+        if address := localAddress(); address != "" {
+            return address
+        }
+        return "NIL"
+
+    case "VER?", "VER":
+        if buildVersion != "" {
+            return buildVersion
+        }
+        return "NIL"
+    }
+    return "?"
+}
+
+
+
+/**
+ * Scheduler task that pings the server so a dead connection is noticed.
+ *
+ * @parent  sc      this function is associated with the
+ *                  socketClient structure
+ */
+func (sc *socketClient) ping() {
+    if SC_CONNECTED == sc.reconnect.state() {
+        atomic.AddInt64(&stats.pings, 1)
+        sc.sendMsg("ping")
+    }
+}
+
+
+
+/**
+ * Scheduler task that prints the activity counters.
+ *
+ * @parent  cs      this function is associated with the
+ *                  clientStats structure
+ */
+func (cs *clientStats) print() {
+    fmt.Println("stats: sent", atomic.LoadInt64(&cs.sent),
+                "received", atomic.LoadInt64(&cs.received),
+                "dials", atomic.LoadInt64(&cs.dials),
+                "pings", atomic.LoadInt64(&cs.pings),
+                "key glitches", atomic.LoadInt64(&cs.debounce.glitches),
+                "held off", atomic.LoadInt64(&cs.debounce.heldOff))
+}
+
+
+
 /**
  * Convert the UnixNano, nanosecond timer value to microseconds.
  *
@@ -424,21 +809,51 @@ func main() {
      * Inform the user that the program has started
      */
     fmt.Println("internet-telegraph starting - version", buildVersion)
+    exitCode := 0
+    defer func() {                              // runs after every other deferred cleanup
+        if exitCode != 0 {
+            os.Exit(exitCode)
+        }
+    }()
+
+
+    /**
+     * Shut down cleanly when systemd or the user asks.
+     */
+    quit := make(chan os.Signal, 1)
+    signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
 
 
     /**
      * Create local variables.
      */
-    var keyValue rpio.State
-    var lastKeyValue rpio.State  = rpio.High    // will a pull up un press = High
     var keyToken string = "0"                   // default to no tone
-    var loopCount   int = 0
 
 
     /**
      * Get the application configuration information
      */
-    config  := getConfiguration()
+    config, source, configErr := loadConfiguration(os.Args[1:])
+    if configErr == flag.ErrHelp {
+        return
+    }
+    if source.printOnly {
+        fmt.Println(config.printable())
+        if configErr != nil {
+            fmt.Println(configErr)
+            os.Exit(2)
+        }
+        return
+    }
+    if configErr != nil {
+        fmt.Println("Configuration error:")
+        fmt.Println(configErr)
+        config.Signals = nil                    // only trust the built in signals
+        config.PlaybackWpm = defaultConfiguration().PlaybackWpm
+    } else {
+        fmt.Println("configuration from", source.path, ":")
+        fmt.Println(config.printable())
+    }
 
 
     /**
@@ -446,115 +861,251 @@ func main() {
      */
     initializeRpio()                            // Initialize the Raspberry Pi IO library
     defer rpio.Close()                          // close and cleanup rpio when main closes
+    if KM_STRAIGHT != config.Keyer.Mode {
+        key.setDahPin(config.Keyer.DahPin)      // a straight key leaves the pin free for an output
+    }
+    statusLight     =   newIndicator(newLEDBackend(config.Indicator), systemClock{})
+    statusLight.tick()                          // show the booting pattern
+    defer statusLight.off()
 
 
 
     /**
      * Initialize the application elements.
      */
-    toneState       =   intitializeToneState(toneState)
+    atomic.StoreInt32(&playbackWpm, int32(config.PlaybackWpm))
+    var recordErr error
+    recorder, recordErr = newSessionRecorder(config.Recorder)
+    if recordErr != nil {
+        fmt.Println("session log:", recordErr)
+    }
+    defer recorder.close()
+    toneState       =   intitializeToneState(toneState, config)
+    defer toneState.release()                   // never leave the sounder pulled in
     toneControl     :=  make(chan rpio.State)   // create channel to communicate with tone
-    go toneState.control( toneControl)          // launch toneState.control Goroutine
-    serverSocket    :=  initializeSocketClient(config)
-    serverSocket.dial( toneControl)             // establish connection to server
+    sideTone        :=  make(chan rpio.State)   // local key
+    signalTone      :=  make(chan rpio.State)   // status signals and replies
+    go toneState.control( toneControl, sideTone, signalTone)  // launch toneState.control Goroutine
+    signals         :=  newStatusSignaller(defaultSignals, config.Signals,
+        func(elements string) {
+            playMorseElements(elements, signalTone)
+        },
+        func(elements string) {
+            statusLight.flash(elements, playbackDitTime())
+        })
+    if configErr != nil {
+        // do not fall back on the defaults and join a channel nobody chose
+        signalConfigError(signals)
+        fmt.Println("Fix the configuration and restart")
+        exitCode = 2
+        return
+    }
+    if source.calibrate {
+        if err := calibrateOutputs(config, source.path); err != nil {
+            fmt.Println("Calibration failed:", err)
+            exitCode = 1
+        }
+        return
+    }
 
-    if SC_CONNECTED == serverSocket.status {
-        playMorseElements(".--. --- ... - ..... ----. ----.", toneControl)  // play "POST599"
+
+    /**
+     * Wait for the network, then connect to the server.
+     */
+    sdNotify("STATUS=waiting for the network")
+    if !waitForNetwork(quit, statusLight) {
+        fmt.Println("Shut down while waiting for the network")
+        return
     }
+    serverSocket    :=  initializeSocketClient(config, signals)
+    serverSocket.dial( toneControl)             // establish connection to server
 
-    go serverSocket.listen(toneControl)         // launch serverSocket.listen Goroutine
 
 
+    /**
+     * Register the periodic work with the scheduler.
+     */
+    sched := newScheduler(systemClock{})
 
 
     /**
-     * Start the main application loop.  This loop runs forever.
+     * While on a less preferred server, check whether a better one has
+     * come back.  The check runs in its own goroutine because it waits
+     * on the network; the switch itself is made by the scheduler.  The
+     * task is registered again when the check interval is changed.
      */
-    for {
-        // TODO organize main loop as a scheduler
-        // This section of the main loop runs everytime
-        // This section of the main loop runs every 5 seconds
-        // This section of the main loop runs every 30 seconds
-
-
-        /**
-         * Verify the connection to the internet-telegraph server
-         * Reconnect to the server is required.
-         *
-         * Attempt several immediate 'silent' reconnects.  If these fail to
-         * reconnect the server, attempt reconnets at a slower rate.  Signify
-         * a successful reconnect by playing 'dit dit' on the Morse code
-         * sounder.  If the server remains disconnected for an extended
-         * period of time, inform the user my playing (8) 'dits' on the Morse
-         * code sounder.
-         */
-        if SC_CONNECTED != serverSocket.status {
-            // attempt to redial
-            serverSocket.redialCount++
-            serverSocket.status         = SC_RECONNECTING
-            if 3 > serverSocket.redialCount {
-                // attempt immediate redails
-                serverSocket.dial( toneControl)       // reestablish connection
-            } else {
-                // TODO redial at slower intervals
-                if 3 == serverSocket.redialCount % 500 {
-                    fmt.Println("Redialing in 5 seconds...")
-                    serverSocket.dial( toneControl)       // reestablish connection
-                    if SC_CONNECTED == serverSocket.status {
-                        // connection restored after prolonged disconnect
-                        playMorseElements("..", toneControl)
-                    }
+    scheduleFailback := func(seconds int) *task {
+        return sched.every("failback", time.Duration(seconds) * time.Second, func() {
+            pool := serverSocket.servers
+            go func() {
+                if pool.checkFailback() {
+                    sched.after("failback switch", 0, func() {
+                        serverSocket.failback(pool, toneControl)
+                    })
                 }
+            }()
+        })
+    }
+    failbackTask := scheduleFailback(config.Failover.FailbackSec)
+
+    var commands *commandInterpreter
+    reloader := newConfigReloader(os.Args[1:], source.path, config,
+        func(old, new Config) {
+            applyConfiguration(old, new, serverSocket, signals, commands, toneControl)
+            if old.Failover.FailbackSec != new.Failover.FailbackSec {
+                sched.cancel(failbackTask)
+                failbackTask = scheduleFailback(new.Failover.FailbackSec)
             }
-            if SC_CONNECTED == serverSocket.status {
-                serverSocket.redialCount = 0
-            }
-            // TODO refine the lost connection signalling protocol
-            if 100 == serverSocket.redialCount {
-                // connection has been down a while, notify user
-                playMorseElements("........", toneControl)
+        },
+        func(err error) {
+            signals.signal(EV_CONFIG_ERROR)
+        })
+
+
+    /**
+     * Listen to the local key for commands.  Replies are played in
+     * their own goroutine so the key is still read while they sound.
+     */
+    commands = newCommandInterpreter(config.Commands, systemClock{},
+        func(words []string) string {
+            return runCommand(words, reloader, serverSocket, signals, commands, toneControl)
+        },
+        func(text string) {
+            elements, err := encodeMorse(text)
+            if err != nil {
+                fmt.Println("cannot reply:", err)
+                return
             }
-        }
+            go playMorseElements(elements, signalTone)
+        })
+    decoder := newMorseDecoder(config.Commands.Wpm, commands.decoded)
+    sched.every("decoder", decoderInterval, func() {
+        decoder.idle(time.Now())
+        commands.idle()
+    })
+
 
+    /**
+     * Verify the connection to the internet-telegraph server
+     * and reconnect to the server if required.
+     */
+    sched.every("connection", connectionCheckInterval, func() {
+        serverSocket.checkConnection(toneControl)
+    })
 
-        /**
-         * Poll the Morse code key input and determine if its state has changed.
-         * if the state has changed, start or stop the tone on the Morse code sounder.
-         */
-        keyValue = key.keyPin.Read()
-        if( keyValue != lastKeyValue) {
-            lastKeyValue = keyValue
-
-            if( rpio.Low == keyValue) {
-                toneControl <- rpio.High    // server supresses echo, use side tone instead
-                keyToken = "1"
-            } else {
-                toneControl <- rpio.Low     // server supresses echo, use side tone instead
-                keyToken = "0"
+
+    /**
+     * Each key down and key up from the key or keyer starts or stops
+     * the tone on the Morse code sounder and is sent to the channel.
+     */
+    hold := keyHold{hold: announceHold, until: time.Now().Add(announceWindow)}
+    key.keyer = newKeyer(config.Keyer, systemClock{}, func(down bool, at time.Time) {
+        if down {
+            sideTone <- rpio.High       // server supresses echo, use side tone instead
+            keyToken = "1"
+            decoder.keyDown(at)
+            hold.keyDown(at)
+        } else {
+            sideTone <- rpio.Low        // server supresses echo, use side tone instead
+            keyToken = "0"
+            decoder.keyUp(at)
+            if hold.keyUp(at) {
+                announce(signals)               // held down to hear the announcement again
             }
-            timestamp := strconv.FormatInt(microseconds(), 10)
-            // fmt.Println(keyValue, timestamp, "v2 - keyValue: timestamp: version")
-            msg := keyToken + timestamp + "v2"
+        }
+        sentUs := at.UnixNano() / 1000           // when the keyer timed the element
+        recorder.record(sessionEvent{Received: time.Now(), Channel: serverSocket.channel,
+                                     Sender: SENDER_LOCAL, Down: down, SentUs: sentUs})
+        timestamp := strconv.FormatInt(sentUs, 10)
+        // fmt.Println(keyToken, timestamp, "v2 - keyValue: timestamp: version")
+        msg := keyToken + timestamp + "v2"
+        if commands.inCommandMode() {
+            // the operator is talking to the telegraph, not the channel
+        } else if SC_CONNECTED == serverSocket.reconnect.state() {
             serverSocket.sendMsg(msg)
+        } else {
+            serverSocket.reconnect.retryNow()   // operator wants to send, redial now
+        }
+    })
+
+    /**
+     * Poll the Morse code key, or paddle levers, filter out contact
+     * bounce, and let the keyer decide what they mean.  The contacts
+     * pull the inputs low when closed.
+     */
+    key.ditFilter = newContactFilter(config.Debounce, systemClock{}, &stats.debounce)
+    key.dahFilter = newContactFilter(config.Debounce, systemClock{}, &stats.debounce)
+    sched.every("key", keyPollInterval, func() {
+        dit := key.ditFilter.filter(rpio.Low == key.keyPin.Read())
+        dah := key.keyer.usesDahLever() && key.dahFilter.filter(rpio.Low == key.dahPin.Read())
+        key.keyer.levers(dit, dah)
+    })
+
+    /**
+     * Show the connection state on the status LED.
+     */
+    sched.every("indicator", indicatorInterval, statusLight.tick)
+    sched.every("indicator mode", indicatorModeInterval, func() {
+        if SC_CONNECTED == serverSocket.reconnect.state() {
+            statusLight.setMode(LED_IDLE)
+        } else if haveNetwork() {
+            statusLight.setMode(LED_NO_SERVER)
+        } else {
+            statusLight.setMode(LED_NO_NETWORK)
         }
+    })
+
+    sched.every("ping", pingInterval, serverSocket.ping)
+    sched.every("stats", statsInterval, stats.print)
 
 
-        /**
-         * Allow the application to sleep.  This allows other computer to perform
-         * other tasks, and reduces the amount of energy used.
-         */
-        time.Sleep(10 * time.Millisecond)
-        if 0 == loopCount % mainLoop30Sec {
-            serverSocket.sendMsg("ping")
+    /**
+     * Apply changes to config.json, or reload on SIGHUP, without
+     * restarting.
+     */
+    sched.every("config watch", configWatchInterval, reloader.checkFile)
+
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            sched.after("reload", 0, func() {
+                reloader.reload("SIGHUP")
+            })
         }
+    }()
 
 
-        /**
-         * Increment the loop control counter
-         */
-        loopCount++
+    /**
+     * Keep the systemd watchdog happy while the scheduler is running.
+     */
+    if interval := watchdogInterval(); interval > 0 {
+        sched.every("watchdog", interval, func() {
+            sdNotify("WATCHDOG=1")
+        })
     }
 
+    go func() {
+        sig := <-quit
+        fmt.Println("Received", sig, "- shutting down")
+        sdNotify("STOPPING=1")
+        sched.stop()
+    }()
+
+
+    /**
+     * Run the scheduled tasks until told to stop.  Between tasks the
+     * scheduler sleeps, which allows the computer to perform other tasks
+     * and reduces the amount of energy used.
+     */
+    sdNotify("READY=1")
+    announce(signals)                           // say who and where we are
+    sched.run()
+
+    if serverSocket.conn != nil {
+        serverSocket.conn.Close()
+    }
+    fmt.Println("internet-telegraph stopped")
 
 } // end func main()
 
@@ -0,0 +1,37 @@
+package main
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+
+
+func TestDialGivesUpOnAServerThatNeverAnswers(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    go func() {
+        for {
+            conn, err := listener.Accept()     // accept, then say nothing
+            if err != nil {
+                return
+            }
+            defer conn.Close()
+        }
+    }()
+
+    started := time.Now()
+    _, err = dialWebsocket("ws://" + listener.Addr().String() + "/channel/test", 200 * time.Millisecond)
+    if err == nil {
+        t.Fatal("handshake with a silent server succeeded")
+    }
+    if waited := time.Since(started); waited > 2 * time.Second {
+        t.Errorf("waited %v for a silent server, want about 200ms", waited)
+    }
+}
+
+/* end of file */
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	term "github.com/nsf/termbox-go"
@@ -23,6 +25,8 @@ var (
 	bufferReferenceTime int64
 	bufferDelay         int64  = 500000 // Default buffer delay
 	lastKeyId           string          // identifier for the telegraph that the current queue came from
+	stationReference    = map[string]int64{} // software audio: bufferReferenceTime for each telegraph heard
+	stationMutex        sync.Mutex           // guards queue and stationReference in software audio
 	lastKeyVal          = "0"
 	gpio                bool
 	t                   tone
@@ -30,20 +34,38 @@ var (
 	pingTimeout         int64 = 5000  // How long to wait after sending a ping before reporting an error (milliseconds)
 	pingTimer           int64
 	pingOutstanding           = false
-	redialInterval      int64 = 1000 // initial number of milliseconds between redial attempts
-	lastRedialTime      int64
+	recorder            *sessionRecorder
 )
 
 type Config struct {
 	Channel string
 	Server  string
-	Port    string
-	Gpio    bool
+	Port      string
+	Gpio      bool
+	Reconnect ReconnectConfig
+	Signals   map[string]SignalConfig
+	Audio     AudioConfig // software side tone when Gpio is false
+	SpkrPin   int         // BCM pin the sounder or buzzer is on
+	ToneHz    int         // hardware PWM tone for a passive piezo on SpkrPin, 0 for on/off
+	ToneDuty  float64     // PWM duty cycle, 0 for 0.5
+	Recorder  RecorderConfig // session log of key events
+}
+
+// Status signals used unless config.json says otherwise
+var defaultSignals = map[string]SignalConfig{
+	EV_CONNECTED:    {Text: "READY", Route: ROUTE_SOUNDER},
+	EV_RECONNECTING: {Text: "<HH>", Route: ROUTE_SOUNDER},
+	EV_RECONNECTED:  {Text: "READY", Route: ROUTE_SOUNDER},
+	EV_OUTAGE:       {Text: "<HH>", Route: ROUTE_OFF},
+	EV_RESTORED:     {Text: "READY", Route: ROUTE_SOUNDER},
+	EV_UNREACHABLE:  {Text: "<HH>", Route: ROUTE_SOUNDER},
+	EV_CONFIG_ERROR: {Text: "<HH> CFG", Route: ROUTE_SOUNDER},
 }
 
 type socketClient struct {
-	ip, port, channel, status string
-	conn                      *websocket.Conn
+	ip, port, channel string
+	reconnect         *reconnector
+	conn              *websocket.Conn
 }
 
 type morseKey struct {
@@ -52,48 +74,47 @@ type morseKey struct {
 }
 
 type tone struct {
-	state   string
-	spkrPin rpio.Pin
+	state string
+	spkr  ledBackend     // sounder, buzzer or PWM piezo when using GPIO
+	audio *toneGenerator // software tone when not using GPIO, may be nil
 }
 
 func (sc *socketClient) dial(firstDial bool) {
 
 	fmt.Println("Dialing 'ws://" + sc.ip + ":" + sc.port + "/channel/" + sc.channel)
 
-	sc.status = "dialling"
+	if sc.conn != nil {
+		sc.conn.Close() // make sure the old listener stops
+	}
+
+	sc.reconnect.dialing()
 	conn, err := websocket.Dial("ws://"+sc.ip+":"+sc.port+"/channel/"+sc.channel, "", "http://localhost")
 	if err == nil {
 		sc.conn = conn
-		playMorse(".-. . .- -.. -.--")
-		sc.status = "connected"
-		fmt.Println("sc.status = " + sc.status)
 		fmt.Print("sc.conn = ")
 		fmt.Println(sc.conn)
+		sc.reconnect.connected(func() error {
+			return sc.listen(conn)
+		})
 		return
 	}
 
 	if err != nil {
 		fmt.Println("Error connecting to 'ws://" + sc.ip + ":" + sc.port + "/channel/" + sc.channel + "': " + err.Error())
-		lastRedialTime = milliseconds()
-
-		redialInterval = redialInterval * 2
-
-		if redialInterval > 30000 {
-			redialInterval = 30000
-		}
-
+		sc.reconnect.dialFailed()
 	}
 
 }
 
+
 func (t *tone) set(value int) {
 	if gpio == true {
 		if value == 0 {
-			t.spkrPin.Write(rpio.Low)
+			t.spkr.set(false)
 			t.state = "OFF"
 
 		} else if value == 1 {
-			t.spkrPin.Write(rpio.High)
+			t.spkr.set(true)
 			t.state = "ON"
 		} else {
 			fmt.Print("Err! Couldn’t set tone to: ")
@@ -101,10 +122,10 @@ func (t *tone) set(value int) {
 		}
 	} else {
 		if value == 0 {
-			// need to figure out the best way to generate + play a tone
+			t.audio.key(false)
 			t.state = "OFF"
 		} else if value == 1 {
-			// need to figure out the best way to generate + play a tone
+			t.audio.key(true)
 			t.state = "ON"
 		} else {
 			fmt.Println("Err! Couldn’t set tone")
@@ -112,35 +133,35 @@ func (t *tone) set(value int) {
 	}
 }
 
+// Key the tone for a remote telegraph. Software audio gives each
+// telegraph its own pitch and place; a GPIO sounder has only one voice.
+func (t *tone) setStation(keyId string, value int) {
+	if gpio == true || (value != 0 && value != 1) {
+		t.set(value)
+		return
+	}
+	t.audio.keyStation(keyId, value == 1)
+	if value == 1 {
+		t.state = "ON"
+	} else {
+		t.state = "OFF"
+	}
+}
+
 func (t *tone) start() {
 	if gpio == true {
-		t.spkrPin.Write(rpio.High)
+		t.spkr.set(true)
 	} else {
-		// TODO: cross-platform way generate and play tone
+		t.audio.key(true)
 	}
 	t.state = "ON"
-
-	// This makes a very bad tone with a piezo buzzer.
-	// go func() {
-	// 	for {
-	// 		select {
-	// 		case <-stopPWM:
-	// 			return
-	// 		default:
-	// 			t.spkrPin.Write(rpio.High)
-	// 			time.Sleep(250 * time.Microsecond)
-	// 			t.spkrPin.Write(rpio.Low)
-	// 			time.Sleep(250 * time.Microsecond)
-	// 		}
-	// 	}
-	// }()
 }
 
 func (t *tone) stop() {
 	if gpio == true {
-		t.spkrPin.Write(rpio.Low)
+		t.spkr.set(false)
 	} else {
-		// TODO: cross-platform generate and play tone
+		t.audio.key(false)
 	}
 	t.state = "OFF"
 }
@@ -198,6 +219,14 @@ func (sc *socketClient) onMessage(m string) {
 	fmt.Print(" at ")
 	fmt.Println(time.Now())
 
+	sentUs := messageSentUs(m[:len(m)-4])
+	recorder.record(sessionEvent{Received: time.Now(), Channel: sc.channel, Sender: keyId, Down: m[:1] == "1", SentUs: sentUs})
+
+	if gpio == false {
+		queueStation(m, keyId, microseconds(), t.audio.jitter())
+		return
+	}
+
 	if keyId != lastKeyId { // if its a different telegraph sending
 		if len(queue) > 0 {
 			// ...and there's already a queue from a different telegraph, do nothing.
@@ -223,47 +252,102 @@ func (sc *socketClient) onMessage(m string) {
 	}
 }
 
-func (sc *socketClient) listen() {
-	fmt.Println("Client listening…")
-	var msg string
+// Queue a message for software audio. Every telegraph has its own
+// voice, so overlapping senders are all queued, each timed from its own
+// bufferReferenceTime, set when it starts sending after a pause. Band
+// conditions on the channel may move the message by up to the jitter
+// given, but never ahead of the one queued before it.
+func queueStation(m string, keyId string, now int64, jitter time.Duration) {
+	stationMutex.Lock()
+	defer stationMutex.Unlock()
+
+	body := m[:len(m)-4]
+	sentUs := messageSentUs(body)
+
+	sending := false
+	var previous int64
+	for _, queued := range queue {
+		if queued[len(queued)-4:] == keyId {
+			sending = true
+			previous = messageSentUs(queued[:len(queued)-4])
+		}
+	}
+	if !sending {
+		stationReference[keyId] = (now + bufferDelay) - sentUs
+	}
+
+	if jitter != 0 {
+		jittered := sentUs + int64(jitter/time.Microsecond)
+		if sending && jittered <= previous {
+			jittered = previous + 1
+		}
+		version := ""
+		if strings.HasSuffix(body, "v2") {
+			version = "v2"
+		}
+		m = m[:1] + strconv.FormatInt(jittered, 10) + version + keyId
+	}
+	queue = append(queue, m)
+}
+
+// Play queued messages from every telegraph as they fall due. The main
+// loop waits for key presses when not using GPIO, so software audio is
+// played from here instead.
+func playStations() {
 	for {
-		if sc.status == "connected" {
-			err := websocket.Message.Receive(sc.conn, &msg)
-			if err != nil {
-				fmt.Println("Websocket error on Message.Receive(): " + err.Error())
-				sc.status = "disconnected"
-				playMorse("........")
-				sc.dial(false)
+		playDueStations(microseconds(), t.setStation)
+		time.Sleep(time.Millisecond)
+	}
+}
 
-			} else {
-				sc.onMessage(msg)
-			}
+// Play the queued messages that are due at 'now', in microseconds, and
+// keep the rest queued.
+func playDueStations(now int64, play func(keyId string, value int)) {
+	stationMutex.Lock()
+	defer stationMutex.Unlock()
+	waiting := queue[:0]
+	for _, m := range queue {
+		keyId := m[len(m)-4:]
+		if messageSentUs(m[:len(m)-4]) < now-stationReference[keyId] {
+			msgValue, _ := strconv.Atoi(m[:1])
+			play(keyId, msgValue)
 		} else {
-			time.Sleep(1 * time.Millisecond)
+			waiting = append(waiting, m)
 		}
 	}
+	queue = waiting
+}
+
+// Receive messages on one connection until it fails. The reconnect
+// manager runs one of these for every connection it makes.
+func (sc *socketClient) listen(conn *websocket.Conn) error {
+	fmt.Println("Client listening…")
+	var msg string
+	for {
+		err := websocket.Message.Receive(conn, &msg)
+		if err != nil {
+			fmt.Println("Websocket error on Message.Receive(): " + err.Error())
+			return err
+		}
+		sc.onMessage(msg)
+	}
 }
 
 func (sc *socketClient) outputListen() {
 	for {
-		if len(outQueue) > 0 && sc.status == "connected" {
+		if len(outQueue) > 0 && sc.reconnect.state() == SC_CONNECTED {
 
 			fmt.Println("Out queue detected in outputListen()")
 
 			fmt.Println("Sending message: " + outQueue[0])
 			sendErr := websocket.Message.Send(sc.conn, outQueue[0])
 			if sendErr != nil {
-				sc.status = "disconnected"
 				fmt.Print("sc.conn in send function = ")
 				fmt.Println(sc.conn)
 				fmt.Println("Could not send message:")
 				fmt.Println(sendErr.Error())
-				if outQueue[0][:1] != "1" { // Error beep only on keyup, to prevent confusion.
-					playMorse("........")
-					fmt.Println("Redialling websocket server…")
-					fmt.Println("Current status: " + sc.status)
-					sc.dial(false)
-				}
+				sc.conn.Close()
+				sc.reconnect.lostCurrent() // the main loop redials
 			} else {
 				fmt.Print("Sent: ")
 				fmt.Println(outQueue[0])
@@ -281,7 +365,8 @@ func main() {
 
 	file, _ := os.Open(os.Getenv("TELEGRAPH_CONFIG_PATH"))
 	decoder := json.NewDecoder(file)
-	config := Config{Gpio: true}
+	config := Config{Gpio: true, Reconnect: defaultReconnectConfig(), Audio: defaultAudioConfig(), SpkrPin: spkrPinBCM,
+		Recorder: defaultRecorderConfig()}
 	err := decoder.Decode(&config)
 	if err != nil {
 		fmt.Println("Error reading config.json: ", err)
@@ -292,6 +377,21 @@ func main() {
 	}
 	fmt.Println(config.Channel)
 
+	var recordErr error
+	recorder, recordErr = newSessionRecorder(config.Recorder)
+	if recordErr != nil {
+		fmt.Println("Error opening the session log: " + recordErr.Error())
+	}
+	defer recorder.close()
+
+	var led *indicator // only take over the LED if a signal is routed to it
+	signals := newStatusSignaller(defaultSignals, config.Signals, playMorse, func(elements string) {
+		if led == nil {
+			led = newIndicator(newSysfsLED("/sys/class/leds/led0"), systemClock{})
+		}
+		led.flash(elements, 50*time.Millisecond)
+	})
+
 	gpio = config.Gpio
 
 	// Initialize morse key
@@ -307,9 +407,7 @@ func main() {
 		}
 		keyPn := rpio.Pin(keyPinBCM)
 		keyPn.Input()
-		spkrPn := rpio.Pin(spkrPinBCM)
-		spkrPn.Output()
-		t.spkrPin = spkrPn
+		t.spkr = newToneOutput(config.SpkrPin, false, config.ToneHz, config.ToneDuty)
 		key.keyPin = keyPn
 
 		defer rpio.Close()
@@ -322,16 +420,31 @@ func main() {
 		}
 
 		defer term.Close()
+
+		// Play the tone through the sound card, or record it
+		sink, sinkErr := newPCMSink(config.Audio)
+		if sinkErr != nil {
+			fmt.Println("Error opening audio output: " + sinkErr.Error())
+			sink = discardSink{}
+		}
+		t.audio = newToneGenerator(config.Audio, sink, systemClock{})
+		t.audio.setChannel(config.Channel)
+		go t.audio.run()
+		defer t.audio.stop()
+		go playStations()
+	}
+
+	if err != nil {
+		signals.signal(EV_CONFIG_ERROR)
 	}
 
 	// Init socketClient & dial websocket
-	sc := socketClient{ip: config.Server, port: config.Port, channel: config.Channel}
+	sc := socketClient{ip: config.Server, port: config.Port, channel: config.Channel,
+		reconnect: newReconnector(config.Reconnect, systemClock{}, signals.signal)}
 
+	// Dial; the reconnect manager starts the listener for incoming messages
 	sc.dial(true)
 
-	// Start the listener for incoming messages
-	go sc.listen()
-
 	// Start the listener that monitors the output queue and sends messages
 	go sc.outputListen()
 
@@ -340,17 +453,11 @@ func main() {
 	// Adding a simplified version of things...
 	for {
 
-		if sc.status != "connected" && sc.status != "dialling" {
-			fmt.Println("Disconnection detected in main loop. Redialling...")
-			playMorse("........")
+		if sc.reconnect.due() {
+			fmt.Println("Redial due in main loop. Redialling...")
 			sc.dial(false) // Connect if broken
 		}
 
-		if sc.status == "dialling" && (milliseconds() > (lastRedialTime + redialInterval)) {
-			fmt.Println("Redial timer complete in main loop. Redialling...")
-			sc.dial(false)
-		}
-
 		var keyVal string
 
 		if gpio == true {
@@ -363,6 +470,8 @@ func main() {
 				case term.EventKey:
 					switch ev.Key {
 					case term.KeyEsc:
+						t.audio.stop() // finish any WAV file
+						term.Close()
 						os.Exit(1)
 					case term.KeySpace:
 						gpioKeyVal = rpio.Low
@@ -386,24 +495,26 @@ func main() {
 		}
 
 		if keyVal != lastKeyVal {
-			if sc.status == "connected" {
+			if sc.reconnect.state() == SC_CONNECTED {
 				fmt.Print("key change: ")
 				fmt.Print(lastKeyVal)
 				fmt.Print(" → ")
 				fmt.Println(keyVal)
 				toneVal, _ := strconv.Atoi(keyVal)
 				t.set(toneVal)
-				timestamp := strconv.FormatInt(microseconds(), 10)
+				now := microseconds()
+				recorder.record(sessionEvent{Received: time.Now(), Channel: sc.channel, Sender: SENDER_LOCAL, Down: keyVal == "1", SentUs: now})
+				timestamp := strconv.FormatInt(now, 10)
 				msg := keyVal + timestamp + "v2"
 				outQueue = append(outQueue, msg)
 				lastKeyVal = keyVal
 			} else {
 				playMorse("........")
-				redialInterval = 1
+				sc.reconnect.retryNow()
 			}
 		}
 
-		if len(queue) > 0 { // If there's an input queue, parse the next message
+		if gpio == true && len(queue) > 0 { // If there's an input queue, parse the next message
 			m := queue[0]
 
 			ts := m[1 : len(queue[0])-4]
@@ -418,7 +529,7 @@ func main() {
 			}
 		}
 
-		if sc.status == "connected" {
+		if sc.reconnect.state() == SC_CONNECTED {
 			// Ping the server periodically to check if we're actually connected
 			if milliseconds() > (pingTimer + pingInterval) {
 				pingTimer = milliseconds()
@@ -428,7 +539,8 @@ func main() {
 
 			if pingOutstanding == true && (milliseconds() > (pingTimer + pingTimeout)) {
 				fmt.Println("Server ping timeout. Connection error.")
-				sc.status = "disconnected"
+				sc.conn.Close()
+				sc.reconnect.lostCurrent()
 				pingOutstanding = false
 			}
 		}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Step the station player through time a millisecond at a time and note
+// when each message is played, in milliseconds after 'from'.
+func playTimes(from int64, until int64) []string {
+	var played []string
+	for now := from; now <= until; now += 1000 {
+		playDueStations(now, func(keyId string, value int) {
+			played = append(played, fmt.Sprintf("%s %d@%d", keyId, value, (now-from)/1000))
+		})
+	}
+	return played
+}
+
+func resetStations() {
+	queue = nil
+	stationReference = map[string]int64{}
+}
+
+func TestStationsAreTimedFromTheirOwnTimestamps(t *testing.T) {
+	resetStations()
+	const start = int64(1000000000000)
+
+	// 0001 sends a dit; its key up arrives 80ms late over the network
+	queueStation("15000000v20001", "0001", start, 0)
+	queueStation("05060000v20001", "0001", start+140000, 0)
+	// 0002's clock is far from 0001's; it starts sending 20ms later
+	queueStation("1900000000v20002", "0002", start+20000, 0)
+	queueStation("0900180000v20002", "0002", start+200000, 0)
+
+	// bufferDelay is 500ms
+	want := []string{"0001 1@501", "0002 1@521", "0001 0@561", "0002 0@701"}
+	if played := playTimes(start, start+1000000); !reflect.DeepEqual(played, want) {
+		t.Errorf("played %v, want %v", played, want)
+	}
+}
+
+func TestJitteredStationsStayInOrderNearTheirTimes(t *testing.T) {
+	resetStations()
+	const start = int64(1000000000000)
+	jitters := []time.Duration{3 * time.Millisecond, -3 * time.Millisecond, 2 * time.Millisecond,
+		-200 * time.Millisecond, time.Millisecond}
+	sent := []int64{5000000, 5060000, 5120000, 5300000, 5360000}
+	for i, us := range sent {
+		queueStation(fmt.Sprintf("%d%dv20001", (i+1)%2, us), "0001", start, jitters[i])
+	}
+
+	for _, m := range queue {
+		if m[len(m)-6:] != "v20001" {
+			t.Errorf("jittered message %q lost its v2 format", m)
+		}
+	}
+	// the fourth would be pulled back past the key down before it, so
+	// it follows that instead
+	want := []string{"0001 1@504", "0001 0@558", "0001 1@623", "0001 0@623", "0001 1@862"}
+	if played := playTimes(start, start+1000000); !reflect.DeepEqual(played, want) {
+		t.Errorf("played %v, want %v", played, want)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+
+
+// playback speeds allowed and how far QRS and QRQ change it
+const(
+    minPlaybackWpm  = 5
+    maxPlaybackWpm  = 40
+    playbackWpmStep = 2
+    )
+
+
+
+/**
+ * Keyed commands, read from the "commands" section of config.json.
+ */
+type CommandConfig struct {
+    Enabled     bool    `json:"enabled"`
+    Prefix      string  `json:"prefix"`     // prosigns that start command mode
+    Wpm         int     `json:"wpm"`        // expected sending speed, the decoder adapts from here
+    TimeoutSec  int     `json:"timeoutSec"` // silence that ends command mode
+}
+
+
+
+func defaultCommandConfig() CommandConfig {
+    return CommandConfig{Enabled: true, Prefix: "<KA> <KA>", Wpm: 15, TimeoutSec: 10}
+}
+
+
+
+/**
+ * Watches the text decoded from the local key for commands.
+ *
+ * Keying the prefix enters command mode and the reply "K" invites a
+ * command.  The command is everything keyed after that up to <AR>, or
+ * up to a pause of TimeoutSec.  <HH> throws away what has been keyed so
+ * far and <SK> leaves command mode without doing anything.  The command
+ * is split into words and passed to 'execute', and whatever it returns
+ * is sent back with 'reply'.
+ *
+ * While in command mode the client does not send the key to the
+ * channel.  The prefix itself has been sent by the time it is
+ * recognised.
+ */
+type commandInterpreter struct {
+    clock       clock
+    execute     func(words []string) string
+    reply       func(text string)
+
+    mutex       sync.Mutex
+    config      CommandConfig
+    prefix      string          // config.Prefix without spaces
+    heard       string          // recent text, without spaces, for spotting the prefix
+    active      bool
+    command     string
+    lastHeard   time.Time
+}
+
+
+
+/**
+ * Create a command interpreter.
+ *
+ * @param   config  command settings
+ * @param   c       clock used for the command mode timeout
+ * @param   execute runs a command and returns the reply text
+ * @param   reply   sends text back to the operator
+ * @return  ci      the command interpreter
+ */
+func newCommandInterpreter(config CommandConfig, c clock,
+                           execute func(words []string) string, reply func(text string)) *commandInterpreter {
+    ci := &commandInterpreter{clock: c, execute: execute, reply: reply}
+    ci.setConfig(config)
+    return ci
+}
+
+
+
+/**
+ * Change the command settings.  Leaves command mode.
+ */
+func (ci *commandInterpreter) setConfig(config CommandConfig) {
+    ci.mutex.Lock()
+    defer ci.mutex.Unlock()
+    ci.config = config
+    ci.prefix = strings.ToUpper(strings.Replace(config.Prefix, " ", "", -1))
+    ci.heard = ""
+    ci.active = false
+    ci.command = ""
+}
+
+
+
+/**
+ * Report whether the key is being used for a command rather than sent
+ * to the channel.
+ */
+func (ci *commandInterpreter) inCommandMode() bool {
+    ci.mutex.Lock()
+    defer ci.mutex.Unlock()
+    return ci.active
+}
+
+
+
+/**
+ * Take the next character or word space from the decoder.
+ *
+ * @param   text    a decoded character, prosign or " "
+ */
+func (ci *commandInterpreter) decoded(text string) {
+    ci.mutex.Lock()
+    if !ci.config.Enabled || ci.prefix == "" {
+        ci.mutex.Unlock()
+        return
+    }
+    ci.lastHeard = ci.clock.now()
+
+    if !ci.active {
+        if " " != text {
+            ci.heard += text
+            if n := len(ci.heard) - 2*len(ci.prefix); n > 0 {
+                ci.heard = ci.heard[n:]
+            }
+        }
+        entered := strings.HasSuffix(ci.heard, ci.prefix)
+        if entered {
+            ci.active = true
+            ci.command = ""
+            ci.heard = ""
+        }
+        ci.mutex.Unlock()
+
+        if entered {
+            fmt.Println("command mode")
+            ci.reply("K")
+        }
+        return
+    }
+
+    finished := false
+    switch text {
+    case "+":                                       // <AR> is the same code as '+'
+        finished = true
+    case "<SK>":
+        finished = true
+        ci.command = ""
+    case "<HH>":
+        ci.command = ""
+    default:
+        ci.command += text
+    }
+    run := ci.command
+    if finished {
+        ci.active = false
+        ci.command = ""
+    }
+    ci.mutex.Unlock()
+
+    if finished {
+        ci.finish(run)
+    }
+}
+
+
+
+/**
+ * Run a command left waiting when the operator stopped keying, or
+ * leave command mode if nothing was keyed.  Scheduler task.
+ */
+func (ci *commandInterpreter) idle() {
+    ci.mutex.Lock()
+    timeout := time.Duration(ci.config.TimeoutSec) * time.Second
+    if !ci.active || ci.clock.now().Sub(ci.lastHeard) < timeout {
+        ci.mutex.Unlock()
+        return
+    }
+    run := ci.command
+    ci.active = false
+    ci.command = ""
+    ci.mutex.Unlock()
+
+    ci.finish(run)
+}
+
+
+
+// run a finished command and send the reply
+func (ci *commandInterpreter) finish(command string) {
+    words := strings.Fields(command)
+    if 0 == len(words) {
+        fmt.Println("command mode ended")
+        return
+    }
+    fmt.Println("command:", words)
+    if answer := ci.execute(words); answer != "" {
+        ci.reply(answer)
+    }
+}
+
+/* end of file */
@@ -0,0 +1,202 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+
+
+/**
+ * An interpreter fed by a decoder on a fake clock, as the local key
+ * feeds them, noting the commands run and the replies sent.
+ */
+type commandSession struct {
+    t           *testing.T
+    clock       *fakeClock
+    decoder     *morseDecoder
+    commands    *commandInterpreter
+    ran         [][]string
+    replies     []string
+}
+
+func newCommandSession(t *testing.T) *commandSession {
+    s := &commandSession{t: t, clock: newFakeClock(time.Unix(1000, 0))}
+    s.commands = newCommandInterpreter(defaultCommandConfig(), s.clock,
+        func(words []string) string {
+            s.ran = append(s.ran, words)
+            return "R"
+        },
+        func(text string) {
+            s.replies = append(s.replies, text)
+        })
+    s.decoder = newMorseDecoder(defaultCommandConfig().Wpm, s.commands.decoded)
+    return s
+}
+
+
+
+/**
+ * Key text or an element string at the interpreter's speed, then stop
+ * long enough for the decoder to finish the word.
+ */
+func (s *commandSession) key(text string) {
+    elements, err := encodeMorse(text)
+    if err != nil {
+        s.t.Fatal(err)
+    }
+    dit := wpmToDit(defaultCommandConfig().Wpm)
+    for _, element := range elements {
+        switch element {
+        case '.':
+            s.decoder.keyDown(s.clock.now())
+            s.clock.advance(dit)
+            s.decoder.keyUp(s.clock.now())
+        case '-':
+            s.decoder.keyDown(s.clock.now())
+            s.clock.advance(3 * dit)
+            s.decoder.keyUp(s.clock.now())
+        case ' ':
+            s.clock.advance(dit)
+        }
+        s.clock.advance(dit)
+    }
+    s.clock.advance(7 * dit)
+    s.decoder.idle(s.clock.now())
+    s.commands.idle()
+}
+
+
+
+// stop keying until command mode times out
+func (s *commandSession) pause() {
+    s.clock.advance(time.Duration(defaultCommandConfig().TimeoutSec) * time.Second)
+    s.decoder.idle(s.clock.now())
+    s.commands.idle()
+}
+
+
+
+func TestKeyedCommandIsDecodedAndRun(t *testing.T) {
+    s := newCommandSession(t)
+    s.key("CQ <KA> <KA>")
+    if !s.commands.inCommandMode() || !reflect.DeepEqual(s.replies, []string{"K"}) {
+        t.Fatalf("after the prefix: command mode %v, replies %v", s.commands.inCommandMode(), s.replies)
+    }
+    s.key("QSY NEWS <AR>")
+    if s.commands.inCommandMode() {
+        t.Error("still in command mode after <AR>")
+    }
+    want := [][]string{{"QSY", "NEWS"}}
+    if !reflect.DeepEqual(s.ran, want) || !reflect.DeepEqual(s.replies, []string{"K", "R"}) {
+        t.Errorf("ran %v replying %v, want %v replying [K R]", s.ran, s.replies, want)
+    }
+}
+
+
+
+func TestCommandElementsDecodeToWords(t *testing.T) {
+    s := newCommandSession(t)
+    s.key("-.-.- -.-.-")                        // <KA> <KA>
+    s.key("--.- .-. --.-")                      // QRQ
+    s.key(".-.-.")                              // <AR>
+    if want := [][]string{{"QRQ"}}; !reflect.DeepEqual(s.ran, want) {
+        t.Errorf("ran %v, want %v", s.ran, want)
+    }
+}
+
+
+
+func TestCommandRunsWhenTheOperatorStops(t *testing.T) {
+    s := newCommandSession(t)
+    s.key("<KA> <KA> VER?")
+    if 0 != len(s.ran) {
+        t.Fatalf("ran %v before the timeout", s.ran)
+    }
+    s.pause()
+    if want := [][]string{{"VER?"}}; !reflect.DeepEqual(s.ran, want) || s.commands.inCommandMode() {
+        t.Errorf("ran %v after the timeout, want %v", s.ran, want)
+    }
+}
+
+
+
+func TestPartialCommandsAreNotRun(t *testing.T) {
+    for name, keyed := range map[string][]string{
+        "half the prefix":          {"<KA> QRS <AR>"},
+        "prefix split by a word":   {"<KA> QRS <KA> QRS <AR>"},
+        "cancelled with SK":        {"<KA> <KA> QSY", "<SK>"},
+        "nothing keyed":            {"<KA> <KA>", "<AR>"},
+        "disabled":                 {"<KA> <KA> QRS <AR>"},
+    } {
+        s := newCommandSession(t)
+        if "disabled" == name {
+            config := defaultCommandConfig()
+            config.Enabled = false
+            s.commands.setConfig(config)
+        }
+        for _, text := range keyed {
+            s.key(text)
+        }
+        s.pause()
+        if 0 != len(s.ran) || s.commands.inCommandMode() {
+            t.Errorf("%s: ran %v, command mode %v", name, s.ran, s.commands.inCommandMode())
+        }
+    }
+}
+
+
+
+func TestCorrectedCommandRunsWhatFollowsHH(t *testing.T) {
+    s := newCommandSession(t)
+    s.key("<KA> <KA> QSX <HH> QSY LOBBY <AR>")
+    if want := [][]string{{"QSY", "LOBBY"}}; !reflect.DeepEqual(s.ran, want) {
+        t.Errorf("ran %v, want %v", s.ran, want)
+    }
+}
+
+
+
+func TestUnknownCommandsAreRejected(t *testing.T) {
+    for name, words := range map[string][]string{
+        "unknown":                  {"QTH?"},
+        "garbled":                  {"Q*S"},
+        "QSY without a channel":    {"QSY"},
+        "QSY with two":             {"QSY", "LOBBY", "NEWS"},
+    } {
+        if reply := runCommand(words, nil, nil, nil, nil, nil); "?" != reply {
+            t.Errorf("%s: replied %q, want \"?\"", name, reply)
+        }
+    }
+
+    s := newCommandSession(t)
+    s.commands.execute = func(words []string) string {
+        return runCommand(words, nil, nil, nil, nil, nil)
+    }
+    s.key("<KA> <KA> Q")
+    s.key(".......")                            // no such character
+    s.key("S <AR>")
+    if !reflect.DeepEqual(s.replies, []string{"K", "?"}) {
+        t.Errorf("replied %v to a garbled command, want [K ?]", s.replies)
+    }
+}
+
+
+
+func TestPlaybackSpeedCommandsStayInRange(t *testing.T) {
+    saved := playbackWpm
+    defer func() {
+        playbackWpm = saved
+    }()
+    playbackWpm = minPlaybackWpm + 1
+    if reply := runCommand([]string{"QRS"}, nil, nil, nil, nil, nil); "5" != reply {
+        t.Errorf("QRS replied %q, want \"5\"", reply)
+    }
+    playbackWpm = maxPlaybackWpm
+    if reply := runCommand([]string{"QRQ"}, nil, nil, nil, nil, nil); "40" != reply {
+        t.Errorf("QRQ replied %q, want \"40\"", reply)
+    }
+}
+
+/* end of file */
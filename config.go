@@ -0,0 +1,365 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+)
+
+
+
+// struction to hold application configuration information
+type Config struct {
+    Channel     string                  `json:"channel"`
+    Server      string                  `json:"server"`
+    Port        string                  `json:"port"`
+    Servers     []ServerConfig          `json:"servers"`  // ordered list, used instead of server/port
+    ServerSrv   string                  `json:"serverSrv"` // domain with a _telegraph._tcp SRV record
+    Failover    FailoverConfig          `json:"failover"`
+    Gpio        bool                    `json:"gpio"`     // no longer used, accepted for old config files
+    Reconnect   ReconnectConfig         `json:"reconnect"`
+    Signals     map[string]SignalConfig `json:"signals"`
+    Indicator   IndicatorConfig         `json:"indicator"`
+    PlaybackWpm int                     `json:"playbackWpm"` // speed of signals and replies
+    Commands    CommandConfig           `json:"commands"`
+    Keyer       KeyerConfig             `json:"keyer"`
+    Debounce    DebounceConfig          `json:"debounce"`
+    BreakIn     BreakInConfig           `json:"breakIn"`
+    Outputs     []OutputConfig          `json:"outputs"`
+    Recorder    RecorderConfig          `json:"recorder"` // session log of key events
+}
+
+
+
+// status signals used unless config.json says otherwise
+var defaultSignals = map[string]SignalConfig{
+    EV_CONNECTED:       {Text: "POST599",   Route: ROUTE_SOUNDER},
+    EV_RECONNECTING:    {Text: "<HH>",      Route: ROUTE_OFF},
+    EV_RECONNECTED:     {Text: "R",         Route: ROUTE_OFF},
+    EV_OUTAGE:          {Text: "<HH>",      Route: ROUTE_SOUNDER},
+    EV_RESTORED:        {Text: "..",        Route: ROUTE_SOUNDER},
+    EV_UNREACHABLE:     {Text: "<HH> <HH>", Route: ROUTE_SOUNDER},
+    EV_CONFIG_ERROR:    {Text: "<HH> CFG",  Route: ROUTE_SOUNDER},
+    EV_FAILOVER:        {Text: "QSY {n}",   Route: ROUTE_SOUNDER},
+    EV_FAILBACK:        {Text: "QSY {n}",   Route: ROUTE_SOUNDER},
+    EV_ANNOUNCE:        {Text: "{ip} {channel} {version}", Route: ROUTE_SOUNDER},
+}
+
+
+
+/**
+ * Where the configuration came from and what the command line asked
+ * for besides configuration values.
+ */
+type configSource struct {
+    path        string      // config file that was read, "" if none
+    printOnly   bool        // print the effective configuration and exit
+    calibrate   bool        // measure the sounders, save the result and exit
+}
+
+
+
+/**
+ * The configuration used when nothing overrides it.
+ *
+ * @return  Config  structure containing the default parameters
+ */
+func defaultConfiguration() Config {
+    return Config{
+        Channel:        "lobby",
+        Server:         "morse.autodidacts.io",
+        Port:           "8000",
+        Gpio:           true,
+        Reconnect:      defaultReconnectConfig(),
+        Indicator:      defaultIndicatorConfig(),
+        Failover:       defaultFailoverConfig(),
+        PlaybackWpm:    13,
+        Commands:       defaultCommandConfig(),
+        Keyer:          defaultKeyerConfig(),
+        Debounce:       defaultDebounceConfig(),
+        BreakIn:        defaultBreakInConfig(),
+        Outputs:        defaultOutputs(),
+        Recorder:       defaultRecorderConfig(),
+    }
+}
+
+
+
+/**
+ * Reads the application configuration.
+ *
+ * Each layer overrides the one before it:
+ *      1. built in defaults (channel "lobby" on morse.autodidacts.io:8000)
+ *      2. the config file: -config, else $TELEGRAPH_CONFIG_PATH, else
+ *         the first config.json on the configSearchPath
+ *      3. environment: TELEGRAPH_CHANNEL, TELEGRAPH_SERVER, TELEGRAPH_PORT
+ *      4. command line flags: -channel, -server, -port
+ *
+ * A server given in the environment or on the command line replaces the
+ * configured server list.
+ *
+ * A config file that was asked for but cannot be read, that has keys
+ * the client does not know, or that has invalid values is an error.
+ * Only a config file that does not exist on the search path falls back
+ * to the defaults.
+ *
+ * @param   args    command line arguments, without the program name
+ * @return  Config  structure containing application parameters
+ * @return  source  where the configuration came from
+ * @return  error   every problem found, if any
+ */
+func loadConfiguration(args []string) (Config, configSource, error) {
+    var source configSource
+    config := defaultConfiguration()
+
+    flags := flag.NewFlagSet("internet-telegraph", flag.ContinueOnError)
+    pathFlag    := flags.String("config", "", "path of the config.json file")
+    channelFlag := flags.String("channel", "", "channel to join")
+    serverFlag  := flags.String("server", "", "server host name")
+    portFlag    := flags.String("port", "", "server port")
+    flags.BoolVar(&source.printOnly, "print-config", false, "print the effective configuration and exit")
+    flags.BoolVar(&source.calibrate, "calibrate", false, "measure sounder pull in and release times through their sense inputs and save them")
+    if err := flags.Parse(args); err != nil {
+        return config, source, err
+    }
+    if flags.NArg() > 0 {
+        return config, source, fmt.Errorf("unexpected arguments: %v", flags.Args())
+    }
+
+    // find the config file
+    explicit := true
+    source.path = *pathFlag
+    if source.path == "" {
+        source.path = os.Getenv("TELEGRAPH_CONFIG_PATH")
+    }
+    if source.path == "" {
+        source.path = findConfigFile()
+        explicit = false
+    }
+
+    // read application configuration from the file
+    if err := readConfigFile(source.path, &config); err != nil {
+        if os.IsNotExist(err) && !explicit {
+            fmt.Println("No config file found, using the defaults")
+            source.path = ""
+        } else {
+            return config, source, fmt.Errorf("%s: %v", source.path, err)
+        }
+    }
+
+    // environment overrides
+    overrideFromEnv(&config.Channel, "TELEGRAPH_CHANNEL")
+    if overrideFromEnv(&config.Server, "TELEGRAPH_SERVER") {
+        config.Servers, config.ServerSrv = nil, ""
+    }
+    overrideFromEnv(&config.Port, "TELEGRAPH_PORT")
+
+    // command line overrides; only flags that were given count
+    flags.Visit(func(f *flag.Flag) {
+        switch f.Name {
+        case "channel":
+            config.Channel = *channelFlag
+        case "server":
+            config.Server = *serverFlag
+            config.Servers, config.ServerSrv = nil, ""
+        case "port":
+            config.Port = *portFlag
+        }
+    })
+
+    if err := config.validate(); err != nil {
+        return config, source, err
+    }
+    config.Signals = mergeSignals(defaultSignals, config.Signals)
+    return config, source, nil
+}
+
+
+
+/**
+ * Decode a config file over the top of 'config'.  Keys that do not
+ * match a configuration field are an error so typing mistakes are not
+ * silently ignored.
+ */
+func readConfigFile(path string, config *Config) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    decoder := json.NewDecoder(file)
+    decoder.DisallowUnknownFields()
+    return decoder.Decode(config)
+}
+
+
+
+func overrideFromEnv(value *string, name string) bool {
+    env, ok := os.LookupEnv(name)
+    if ok {
+        *value = env
+    }
+    return ok
+}
+
+
+
+/**
+ * Check the configuration for values the client cannot use.
+ *
+ * @return  error   one line per problem, or nil if there are none
+ */
+func (config Config) validate() error {
+    var problems []string
+    add := func(format string, args ...interface{}) {
+        problems = append(problems, fmt.Sprintf(format, args...))
+    }
+
+    if config.Channel == "" || strings.ContainsAny(config.Channel, "/?# ") {
+        add("channel %q must be a non empty name without '/', '?', '#' or spaces", config.Channel)
+    }
+    if config.Server == "" || strings.ContainsAny(config.Server, "/:") {
+        add("server %q must be a host name", config.Server)
+    }
+    if port, err := strconv.Atoi(config.Port); err != nil || port < 1 || port > 65535 {
+        add("port %q must be a number from 1 to 65535", config.Port)
+    }
+
+    for i, server := range config.Servers {
+        if server.Server == "" || strings.ContainsAny(server.Server, "/:") {
+            add("servers[%d]: server %q must be a host name", i, server.Server)
+        }
+        if port, err := strconv.Atoi(server.Port); err != nil || port < 1 || port > 65535 {
+            add("servers[%d]: port %q must be a number from 1 to 65535", i, server.Port)
+        }
+    }
+    if config.Failover.FailAfter < 1 || config.Failover.FailbackSec < 1 {
+        add("failover failAfter and failbackSec must be at least 1")
+    }
+
+    rc := config.Reconnect
+    if rc.InitialDelayMs <= 0 || rc.MaxDelayMs < rc.InitialDelayMs {
+        add("reconnect delays must satisfy 0 < initialDelayMs <= maxDelayMs")
+    }
+    if rc.Jitter < 0 || rc.Jitter > 1 {
+        add("reconnect jitter %v must be from 0 to 1", rc.Jitter)
+    }
+    if rc.SilentAttempts < 0 || rc.AlertAfter < 1 || rc.GiveUpAfter < 0 {
+        add("reconnect attempt counts must not be negative and alertAfter must be at least 1")
+    }
+
+    for event, sig := range config.Signals {
+        if _, known := defaultSignals[event]; !known {
+            add("signals: unknown event %q", event)
+        }
+        switch sig.Route {
+        case "", ROUTE_SOUNDER, ROUTE_LED, ROUTE_OFF:
+        default:
+            add("signals: %s route %q must be %s, %s or %s", event, sig.Route, ROUTE_SOUNDER, ROUTE_LED, ROUTE_OFF)
+        }
+        if err := checkSignalText(sig.Text); err != nil {
+            add("signals: %s: %v", event, err)
+        }
+    }
+
+    switch config.Indicator.Backend {
+    case "sysfs", "gpio", "off":
+    default:
+        add("indicator backend %q must be sysfs, gpio or off", config.Indicator.Backend)
+    }
+
+    if config.PlaybackWpm < minPlaybackWpm || config.PlaybackWpm > maxPlaybackWpm {
+        add("playbackWpm %d must be from %d to %d", config.PlaybackWpm, minPlaybackWpm, maxPlaybackWpm)
+    }
+    if config.Commands.Wpm < 1 || config.Commands.TimeoutSec < 1 {
+        add("commands wpm and timeoutSec must be at least 1")
+    }
+    if _, err := encodeMorse(config.Commands.Prefix); config.Commands.Enabled && err != nil {
+        add("commands prefix: %v", err)
+    }
+
+    switch config.Keyer.Mode {
+    case KM_STRAIGHT, KM_BUG, KM_IAMBIC_A, KM_IAMBIC_B:
+    default:
+        add("keyer mode %q must be %s, %s, %s or %s", config.Keyer.Mode, KM_STRAIGHT, KM_BUG, KM_IAMBIC_A, KM_IAMBIC_B)
+    }
+    if config.Keyer.Wpm < 5 || config.Keyer.Wpm > 60 {
+        add("keyer wpm %d must be from 5 to 60", config.Keyer.Wpm)
+    }
+    if config.Keyer.DahPin < 0 || config.Keyer.DahPin > 27 || keyPinBCM == config.Keyer.DahPin {
+        add("keyer dahPin %d must be a BCM pin from 0 to 27 other than the key pin %d", config.Keyer.DahPin, keyPinBCM)
+    }
+    if config.Debounce.MinElementMs < 0 || config.Debounce.HoldOffMs < 0 {
+        add("debounce minElementMs and holdOffMs must not be negative")
+    }
+    switch config.BreakIn.Policy {
+    case BK_BREAKIN, BK_SIDETONE, BK_MIXED:
+    default:
+        add("breakIn policy %q must be %s, %s or %s", config.BreakIn.Policy, BK_BREAKIN, BK_SIDETONE, BK_MIXED)
+    }
+    if config.BreakIn.HangMs < 0 {
+        add("breakIn hangMs must not be negative")
+    }
+    for i, output := range config.Outputs {
+        if output.Pin < 0 || output.Pin > 27 || keyPinBCM == output.Pin ||
+           (KM_STRAIGHT != config.Keyer.Mode && config.Keyer.DahPin == output.Pin) {
+            add("outputs[%d]: pin %d must be a BCM pin from 0 to 27 that is not a key input", i, output.Pin)
+        }
+        switch output.Source {
+        case OUT_SOUNDER, OUT_LOCAL, OUT_REMOTE, OUT_STATUS:
+        default:
+            add("outputs[%d]: source %q must be %s, %s, %s or %s", i, output.Source, OUT_SOUNDER, OUT_LOCAL, OUT_REMOTE, OUT_STATUS)
+        }
+        if output.Channel != "" && OUT_REMOTE != output.Source {
+            add("outputs[%d]: channel can only be given with the %s source", i, OUT_REMOTE)
+        }
+        if output.PullInMs < 0 || output.PullInMs > 100 || output.ReleaseMs < 0 || output.ReleaseMs > 100 {
+            add("outputs[%d]: pullInMs and releaseMs must be from 0 to 100", i)
+        }
+        if output.SensePin != 0 && (output.SensePin < 2 || output.SensePin > 27 || keyPinBCM == output.SensePin ||
+                                    config.Keyer.DahPin == output.SensePin || outputUsesPin(config.Outputs, output.SensePin)) {
+            add("outputs[%d]: sensePin %d must be a BCM pin from 2 to 27 that is not a key input or output, or 0 for none",
+                i, output.SensePin)
+        }
+        if output.ToneHz != 0 && (output.ToneHz < 100 || output.ToneHz > 10000) {
+            add("outputs[%d]: toneHz %d must be from 100 to 10000, or 0 for on/off", i, output.ToneHz)
+        }
+        if output.Duty < 0 || output.Duty >= 1 {
+            add("outputs[%d]: duty %v must be from 0 up to 1", i, output.Duty)
+        }
+        for _, earlier := range config.Outputs[:i] {
+            if earlier.Pin == output.Pin && earlier.ActiveLow != output.ActiveLow {
+                add("outputs[%d]: pin %d is listed with both polarities", i, output.Pin)
+                break
+            }
+        }
+    }
+    if config.Recorder.MaxKB < 0 || config.Recorder.Keep < 0 {
+        add("recorder maxKB and keep must not be negative")
+    }
+
+    if len(problems) > 0 {
+        return errors.New(strings.Join(problems, "\n"))
+    }
+    return nil
+}
+
+
+
+/**
+ * The configuration as indented JSON.  Nothing in it is secret, so it
+ * is printed whole.
+ *
+ * @return  string  the printable configuration
+ */
+func (config Config) printable() string {
+    out, _ := json.MarshalIndent(config, "", "  ")
+    return string(out)
+}
+
+/* end of file */
@@ -0,0 +1,233 @@
+package main
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+
+
+/**
+ * Set or clear the configuration environment variables for one test,
+ * and point the config file search somewhere empty.
+ *
+ * @param   env     variables to set, every other TELEGRAPH_ variable is unset
+ * @return  string  a directory for the test's config files
+ */
+func configEnvironment(t *testing.T, env map[string]string) string {
+    dir := t.TempDir()
+    saved := configSearchPath
+    configSearchPath = []string{filepath.Join(dir, "config.json")}
+    t.Cleanup(func() {
+        configSearchPath = saved
+    })
+    for _, name := range []string{"TELEGRAPH_CONFIG_PATH", "TELEGRAPH_CHANNEL", "TELEGRAPH_SERVER", "TELEGRAPH_PORT"} {
+        t.Setenv(name, env[name])                 // restored when the test ends
+        if _, set := env[name]; !set {
+            os.Unsetenv(name)
+        }
+    }
+    return dir
+}
+
+
+
+func writeConfigFile(t *testing.T, dir string, contents string) string {
+    path := filepath.Join(dir, "config.json")
+    if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+
+
+const layeredConfigFile = `{
+    "channel": "file",
+    "server": "file.example.org",
+    "port": "9000",
+    "servers": [{"server": "one.example.org", "port": "8000"}]
+}`
+
+
+
+func TestConfigurationLayersOverrideInOrder(t *testing.T) {
+    for _, test := range []struct {
+        name    string
+        file    bool
+        env     map[string]string
+        args    []string
+        want    Config                      // channel, server, port and servers
+    }{
+        {"defaults", false, nil, nil,
+         Config{Channel: "lobby", Server: "morse.autodidacts.io", Port: "8000"}},
+        {"file", true, nil, nil,
+         Config{Channel: "file", Server: "file.example.org", Port: "9000",
+                Servers: []ServerConfig{{"one.example.org", "8000"}}}},
+        {"environment", true, map[string]string{"TELEGRAPH_CHANNEL": "env", "TELEGRAPH_PORT": "9001"}, nil,
+         Config{Channel: "env", Server: "file.example.org", Port: "9001",
+                Servers: []ServerConfig{{"one.example.org", "8000"}}}},
+        {"environment server", true, map[string]string{"TELEGRAPH_SERVER": "env.example.org"}, nil,
+         Config{Channel: "file", Server: "env.example.org", Port: "9000"}},
+        {"flags", true, map[string]string{"TELEGRAPH_CHANNEL": "env", "TELEGRAPH_PORT": "9001"},
+         []string{"-channel", "flag", "-port", "9002"},
+         Config{Channel: "flag", Server: "file.example.org", Port: "9002",
+                Servers: []ServerConfig{{"one.example.org", "8000"}}}},
+        {"flag server", true, map[string]string{"TELEGRAPH_SERVER": "env.example.org"},
+         []string{"-server", "flag.example.org"},
+         Config{Channel: "file", Server: "flag.example.org", Port: "9000"}},
+    } {
+        t.Run(test.name, func(t *testing.T) {
+            dir := configEnvironment(t, test.env)
+            if test.file {
+                writeConfigFile(t, dir, layeredConfigFile)
+            }
+            config, source, err := loadConfiguration(test.args)
+            if err != nil {
+                t.Fatal(err)
+            }
+            got := Config{Channel: config.Channel, Server: config.Server, Port: config.Port, Servers: config.Servers}
+            if !reflect.DeepEqual(got, test.want) {
+                t.Errorf("loaded %+v, want %+v", got, test.want)
+            }
+            if (source.path != "") != test.file {
+                t.Errorf("config file %q, want one: %v", source.path, test.file)
+            }
+        })
+    }
+}
+
+
+
+func TestConfigFileIsFoundFromTheEnvironmentOrFlag(t *testing.T) {
+    dir := configEnvironment(t, nil)
+    path := filepath.Join(dir, "elsewhere.json")
+    if err := os.WriteFile(path, []byte(`{"channel": "elsewhere"}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    t.Setenv("TELEGRAPH_CONFIG_PATH", path)
+    if config, _, err := loadConfiguration(nil); err != nil || config.Channel != "elsewhere" {
+        t.Errorf("with TELEGRAPH_CONFIG_PATH loaded channel %q, error %v", config.Channel, err)
+    }
+
+    t.Setenv("TELEGRAPH_CONFIG_PATH", filepath.Join(dir, "missing.json"))
+    if _, _, err := loadConfiguration(nil); err == nil {
+        t.Error("a missing config file named in the environment is not an error")
+    }
+    if config, _, err := loadConfiguration([]string{"-config", path}); err != nil || config.Channel != "elsewhere" {
+        t.Errorf("with -config loaded channel %q, error %v", config.Channel, err)
+    }
+}
+
+
+
+func TestConfigFileRejectsUnknownKeys(t *testing.T) {
+    for _, contents := range []string{
+        `{"chanel": "typo"}`,
+        `{"keyer": {"mode": "straight", "dahpins": 8}}`,
+        `{"outputs": [{"pin": 10, "source": "sounder", "colour": "red"}]}`,
+    } {
+        dir := configEnvironment(t, nil)
+        writeConfigFile(t, dir, contents)
+        if _, _, err := loadConfiguration(nil); err == nil || !strings.Contains(err.Error(), "unknown field") {
+            t.Errorf("%s: error %v, want an unknown field", contents, err)
+        }
+    }
+}
+
+
+
+func TestDefaultConfigurationIsValid(t *testing.T) {
+    if err := defaultConfiguration().validate(); err != nil {
+        t.Error(err)
+    }
+}
+
+
+
+func TestValidateReportsEachProblem(t *testing.T) {
+    for _, test := range []struct {
+        name    string
+        change  func(*Config)
+        want    string                      // part of the problem reported, "" for none
+    }{
+        {"channel", func(c *Config) { c.Channel = "a/b" }, "channel"},
+        {"server", func(c *Config) { c.Server = "host:80" }, "server"},
+        {"port", func(c *Config) { c.Port = "65536" }, "port"},
+        {"servers", func(c *Config) { c.Servers = []ServerConfig{{"ok.example.org", "x"}} }, "servers[0]: port"},
+        {"failover", func(c *Config) { c.Failover.FailAfter = 0 }, "failover"},
+        {"reconnect delays", func(c *Config) { c.Reconnect.MaxDelayMs = c.Reconnect.InitialDelayMs - 1 }, "reconnect delays"},
+        {"reconnect jitter", func(c *Config) { c.Reconnect.Jitter = 1.5 }, "reconnect jitter"},
+        {"reconnect counts", func(c *Config) { c.Reconnect.AlertAfter = 0 }, "reconnect attempt counts"},
+        {"signal event", func(c *Config) { c.Signals = map[string]SignalConfig{"party": {Text: "E"}} }, "unknown event"},
+        {"signal route", func(c *Config) {
+            c.Signals = map[string]SignalConfig{EV_CONNECTED: {Text: "E", Route: "bell"}}
+        }, "route"},
+        {"signal text", func(c *Config) { c.Signals = map[string]SignalConfig{EV_CONNECTED: {Text: "~"}} }, "signals: "},
+        {"indicator", func(c *Config) { c.Indicator.Backend = "lamp" }, "indicator backend"},
+        {"playback", func(c *Config) { c.PlaybackWpm = maxPlaybackWpm + 1 }, "playbackWpm"},
+        {"commands", func(c *Config) { c.Commands.TimeoutSec = 0 }, "commands wpm"},
+        {"command prefix", func(c *Config) { c.Commands.Prefix = "~" }, "commands prefix"},
+        {"keyer mode", func(c *Config) { c.Keyer.Mode = "cootie" }, "keyer mode"},
+        {"keyer wpm", func(c *Config) { c.Keyer.Wpm = 61 }, "keyer wpm"},
+        {"dah on key pin", func(c *Config) { c.Keyer.DahPin = keyPinBCM }, "keyer dahPin"},
+        {"dah pin range", func(c *Config) { c.Keyer.DahPin = 28 }, "keyer dahPin"},
+        {"debounce", func(c *Config) { c.Debounce.HoldOffMs = -1 }, "debounce"},
+        {"break in policy", func(c *Config) { c.BreakIn.Policy = "duplex" }, "breakIn policy"},
+        {"break in hang", func(c *Config) { c.BreakIn.HangMs = -1 }, "breakIn hangMs"},
+        {"output on key pin", func(c *Config) {
+            c.Outputs = append(c.Outputs, OutputConfig{Pin: keyPinBCM, Source: OUT_LOCAL})
+        }, "outputs[2]: pin 7"},
+        {"output on paddle dah pin", func(c *Config) {
+            c.Keyer.Mode = KM_IAMBIC_B
+            c.Outputs = append(c.Outputs, OutputConfig{Pin: c.Keyer.DahPin, Source: OUT_LOCAL})
+        }, "outputs[2]: pin 8"},
+        {"output on straight key dah pin", func(c *Config) {
+            c.Outputs = append(c.Outputs, OutputConfig{Pin: c.Keyer.DahPin, Source: OUT_LOCAL})
+        }, ""},
+        {"output source", func(c *Config) { c.Outputs[0].Source = "bell" }, "outputs[0]: source"},
+        {"output channel", func(c *Config) { c.Outputs[0].Channel = "lobby" }, "outputs[0]: channel"},
+        {"output timing", func(c *Config) { c.Outputs[0].PullInMs = 101 }, "outputs[0]: pullInMs"},
+        {"sense on an output", func(c *Config) { c.Outputs[0].SensePin = spkrPinBCML }, "outputs[0]: sensePin"},
+        {"sense on the dah pin", func(c *Config) { c.Outputs[0].SensePin = c.Keyer.DahPin }, "outputs[0]: sensePin"},
+        {"sense on the key pin", func(c *Config) { c.Outputs[0].SensePin = keyPinBCM }, "outputs[0]: sensePin"},
+        {"sense on a serial pin", func(c *Config) { c.Outputs[0].SensePin = 1 }, "outputs[0]: sensePin"},
+        {"sense pin", func(c *Config) { c.Outputs[0].SensePin = 17 }, ""},
+        {"tone", func(c *Config) { c.Outputs[0].ToneHz = 50 }, "outputs[0]: toneHz"},
+        {"duty", func(c *Config) { c.Outputs[0].Duty = 1 }, "outputs[0]: duty"},
+        {"polarity", func(c *Config) {
+            c.Outputs = append(c.Outputs, OutputConfig{Pin: spkrPinBCM, Source: OUT_LOCAL, ActiveLow: true})
+        }, "outputs[2]: pin 10 is listed with both polarities"},
+        {"recorder", func(c *Config) { c.Recorder.Keep = -1 }, "recorder"},
+    } {
+        config := defaultConfiguration()
+        test.change(&config)
+        err := config.validate()
+        switch {
+        case "" == test.want && err != nil:
+            t.Errorf("%s: unexpected problem %v", test.name, err)
+        case "" == test.want:
+        case err == nil:
+            t.Errorf("%s: no problem reported, want %q", test.name, test.want)
+        case strings.Count(err.Error(), "\n") > 0 || !strings.Contains(err.Error(), test.want):
+            t.Errorf("%s: reported %q, want only %q", test.name, err, test.want)
+        }
+    }
+}
+
+
+
+func TestValidateReportsEveryProblemAtOnce(t *testing.T) {
+    config := defaultConfiguration()
+    config.Channel, config.Port, config.Keyer.Wpm = "", "0", 1
+    err := config.validate()
+    if err == nil || 3 != len(strings.Split(err.Error(), "\n")) {
+        t.Errorf("reported %v, want three problems", err)
+    }
+}
+
+/* end of file */
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "time"
+)
+
+
+
+// how often the network is checked while waiting for it at start up
+const networkCheckInterval = 2 * time.Second
+
+
+
+/**
+ * Places config.json is looked for, in order.  The working directory
+ * comes first so a copy next to the binary still wins; "/" is where the
+ * original rc.local installation put it.
+ */
+var configSearchPath = []string{
+    "config.json",
+    "/etc/internet-telegraph/config.json",
+    "/config.json",
+}
+
+
+
+/**
+ * Find the first config.json on the search path.
+ *
+ * @return  string  path of the file, or the first search entry if none
+ *                  exist so the error message names a sensible file
+ */
+func findConfigFile() string {
+    for _, path := range configSearchPath {
+        if _, err := os.Stat(path); err == nil {
+            return path
+        }
+    }
+    return configSearchPath[0]
+}
+
+
+
+/**
+ * Wait until the network is usable, replacing the gateway ping loop
+ * that used to live in rc.local.
+ *
+ * The network is usable once an interface has an address and there is
+ * a default route.  The status LED shows LED_NO_NETWORK while waiting.
+ *
+ * @param   quit    receives a value if the wait should be abandoned
+ * @param   light   status LED to update, may be nil
+ * @return  bool    true if the network came up, false if told to quit
+ */
+func waitForNetwork(quit <-chan os.Signal, light *indicator) bool {
+    for !haveNetwork() || !haveDefaultRoute() {
+        fmt.Println("Waiting for the network...")
+        if light != nil {
+            light.setMode(LED_NO_NETWORK)
+        }
+        deadline := time.Now().Add(networkCheckInterval)
+        for time.Now().Before(deadline) {
+            select {
+            case <-quit:
+                return false
+            case <-time.After(indicatorInterval):
+                if light != nil {
+                    light.tick()
+                }
+            }
+        }
+    }
+    fmt.Println("Network is up")
+    return true
+}
+
+
+
+/**
+ * Report whether the kernel routing table has a default route.  Where
+ * /proc/net/route does not exist the check is skipped.
+ */
+func haveDefaultRoute() bool {
+    file, err := os.Open("/proc/net/route")
+    if err != nil {
+        return true
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Scan()                          // skip the heading
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) > 1 && fields[1] == "00000000" {
+            return true
+        }
+    }
+    return false
+}
+
+
+
+/**
+ * Send a state notification to systemd, e.g. "READY=1".
+ *
+ * Does nothing when not started by systemd with Type=notify, so the
+ * client still runs from the command line.
+ *
+ * @param   state   newline separated sd_notify assignments
+ * @return  error   set if the notification could not be sent
+ */
+func sdNotify(state string) error {
+    socket := os.Getenv("NOTIFY_SOCKET")
+    if socket == "" {
+        return nil
+    }
+    if socket[0] == '@' {
+        socket = "\x00" + socket[1:]        // abstract socket namespace
+    }
+
+    conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    _, err = conn.Write([]byte(state))
+    return err
+}
+
+
+
+/**
+ * How often systemd expects a watchdog ping, if the unit has
+ * WatchdogSec set.  Pings are sent at half the timeout.
+ *
+ * @return  time.Duration   ping interval, or 0 if there is no watchdog
+ */
+func watchdogInterval() time.Duration {
+    usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+    if err != nil || usec <= 0 {
+        return 0
+    }
+    if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+        return 0
+    }
+    return time.Duration(usec) * time.Microsecond / 2
+}
+
+
+
+/**
+ * The first IPv4 address of an interface that is up and is not the
+ * loopback, for telling the operator where to SSH to.
+ *
+ * @return  string  the address, or "" if there is none
+ */
+func localAddress() string {
+    interfaces, err := net.Interfaces()
+    if err != nil {
+        return ""
+    }
+    for _, iface := range interfaces {
+        if 0 == iface.Flags & net.FlagUp || 0 != iface.Flags & net.FlagLoopback {
+            continue
+        }
+        addrs, err := iface.Addrs()
+        if err != nil {
+            continue
+        }
+        for _, addr := range addrs {
+            if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+                return ipnet.IP.String()
+            }
+        }
+    }
+    return ""
+}
+
+/* end of file */
@@ -0,0 +1,132 @@
+package main
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+
+
+/**
+ * Key contact filtering, read from the "debounce" section of
+ * config.json.  Zero turns either part of the filter off.
+ */
+type DebounceConfig struct {
+    MinElementMs    int     `json:"minElementMs"`   // a change must last this long to count
+    HoldOffMs       int     `json:"holdOffMs"`      // closures ignored for this long after a release
+}
+
+
+
+func defaultDebounceConfig() DebounceConfig {
+    return DebounceConfig{MinElementMs: 5, HoldOffMs: 10}
+}
+
+
+
+// transitions thrown away by the contact filters
+type debounceStats struct {
+    glitches    int64       // changes that did not last minElementMs
+    heldOff     int64       // closures during the hold-off after a release
+}
+
+
+
+/**
+ * Cleans up a key contact before the keyer sees it.
+ *
+ * A change of contact state only counts once it has lasted
+ * MinElementMs, so the 1 - 3 ms bursts from a worn key or a long lead
+ * are dropped.  Closing and opening are delayed by the same amount, so
+ * element lengths are not changed.  After a release the contact is
+ * ignored for HoldOffMs so bounce as the contact opens cannot start a
+ * new element.  Every transition thrown away is counted.
+ */
+type contactFilter struct {
+    clock       clock
+    stats       *debounceStats
+
+    mutex       sync.Mutex
+    config      DebounceConfig
+    closed      bool            // filtered state
+    changing    bool            // the raw contact differs from the filtered state
+    changedAt   time.Time       // when it started to differ
+    releasedAt  time.Time       // when the filtered state last opened
+    holding     bool            // a closure is being ignored during hold-off
+}
+
+
+
+/**
+ * Create a contact filter.
+ *
+ * @param   config  filter settings
+ * @param   c       clock the contact is timed with
+ * @param   stats   counters of dropped transitions, may be shared
+ * @return  f       the contact filter, with the contact open
+ */
+func newContactFilter(config DebounceConfig, c clock, stats *debounceStats) *contactFilter {
+    return &contactFilter{clock: c, stats: stats, config: config}
+}
+
+
+
+/**
+ * Change the filter settings.
+ */
+func (f *contactFilter) setConfig(config DebounceConfig) {
+    f.mutex.Lock()
+    f.config = config
+    f.mutex.Unlock()
+}
+
+
+
+/**
+ * Take the latest reading of the contact.
+ *
+ * @param   raw     true if the contact is closed
+ * @return  bool    the filtered contact state
+ */
+func (f *contactFilter) filter(raw bool) bool {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    now := f.clock.now()
+
+    if raw == f.closed {
+        if f.changing {
+            f.changing = false
+            atomic.AddInt64(&f.stats.glitches, 1)
+        }
+        f.holding = false
+        return f.closed
+    }
+
+    holdOff := time.Duration(f.config.HoldOffMs) * time.Millisecond
+    if raw && !f.releasedAt.IsZero() && now.Sub(f.releasedAt) < holdOff {
+        if !f.holding {
+            f.holding = true
+            atomic.AddInt64(&f.stats.heldOff, 1)
+        }
+        return f.closed
+    }
+    f.holding = false
+
+    if !f.changing {
+        f.changing = true
+        f.changedAt = now
+    }
+    if now.Sub(f.changedAt) < time.Duration(f.config.MinElementMs) * time.Millisecond {
+        return f.closed
+    }
+
+    f.changing = false
+    f.closed = raw
+    if !raw {
+        f.releasedAt = now
+    }
+    return f.closed
+}
+
+/* end of file */
@@ -0,0 +1,265 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "math"
+    "sort"
+    "time"
+)
+
+
+
+// tone detection
+const(
+    detectBlock     = 5 * time.Millisecond      // each block is one keyed or unkeyed reading
+    detectWindow    = 1200 * time.Millisecond   // the levels are judged over this much audio
+    detectHop       = 100 * time.Millisecond    // how often the threshold is worked out again
+    detectSnr       = 6.0                       // tone to noise needed before anything is a tone
+    detectOn        = 0.55                      // key down above this far from noise to tone
+    detectOff       = 0.35                      // key up below this far
+    detectHold      = 2                         // blocks a new state must last, to drop crackles
+    pitchBlock      = 40 * time.Millisecond     // finer frequency resolution for finding the pitch
+    pitchMinHz      = 300.0
+    pitchMaxHz      = 1500.0
+    pitchStepHz     = 10.0
+    )
+
+
+
+// the key going down or up, found in audio
+type toneEdge struct {
+    at      time.Duration       // from the start of the audio
+    down    bool
+}
+
+
+
+/**
+ * Decode CW from a WAV file into key events.
+ *
+ *      telegraph-tool decode [-config config.json] [-pitch 0] [-wpm 20]
+ *                            [-o session.log] [-sender wav] [-inject] [-to channel] audio.wav
+ *
+ * The whole file is read and its keying found first, then the text is
+ * printed.  The key events can be written to a session log, for replay
+ * and export, or sent into a channel as a station of their own.
+ *
+ * @param   args    the command line after "decode"
+ * @return  error   set if the audio could not be decoded
+ */
+func decodeCommand(args []string) error {
+    flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+    configPath := flags.String("config", "config.json", "telegraph config file with the server and channel")
+    pitch := flags.Float64("pitch", 0, "tone to listen for in Hz, 0 to find the strongest")
+    wpm := flags.Int("wpm", 20, "expected sending speed, the decoder follows the sender from there")
+    out := flags.String("o", "", "session log to write the key events to")
+    sender := flags.String("sender", "wav", "sender id for the key events")
+    inject := flags.Bool("inject", false, "send the key events into a channel, with the original timing")
+    to := flags.String("to", "", "channel to inject into, instead of the one in the config file")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if flags.NArg() != 1 {
+        return errors.New("give one WAV file to decode")
+    }
+    samples, rate, err := readWav(flags.Arg(0))
+    if err != nil {
+        return err
+    }
+    if *pitch <= 0 {
+        *pitch = findPitch(samples, rate)
+        fmt.Println("Strongest tone is at", *pitch, "Hz")
+    }
+
+    edges := detectKeying(samples, rate, *pitch)
+    if 0 == len(edges) {
+        return errors.New("no keying found")
+    }
+    start := time.Now()
+    fmt.Println(decodeEdges(edges, start, *wpm))
+
+    config, err := loadToolConfig(*configPath)
+    if err != nil {
+        return err
+    }
+    if *to != "" {
+        config.Channel = *to
+    }
+    var events []sessionEvent
+    for _, edge := range edges {
+        at := start.Add(edge.at)
+        events = append(events, sessionEvent{Received: at, Channel: config.Channel, Sender: *sender,
+                                             Down: edge.down, SentUs: at.UnixNano() / int64(time.Microsecond)})
+    }
+    if *out != "" {
+        recorder, err := newSessionRecorder(RecorderConfig{Path: *out})
+        if err != nil {
+            return err
+        }
+        for _, e := range events {
+            recorder.record(e)
+        }
+        recorder.close()
+    }
+    if *inject {
+        channel := newChannelReplay(config)
+        defer channel.close()
+        replaySession(events, 1, 0, systemClock{}, channel)
+    }
+    return nil
+}
+
+
+
+/**
+ * The text a Morse decoder makes of some key edges.
+ *
+ * @param   edges   the key going down and up
+ * @param   start   the time the audio starts at
+ * @param   wpm     expected sending speed
+ * @return  string  the text
+ */
+func decodeEdges(edges []toneEdge, start time.Time, wpm int) string {
+    var text string
+    decoder := newMorseDecoder(wpm, func(decoded string) {
+        text += decoded
+    })
+    for _, edge := range edges {
+        if edge.down {
+            decoder.keyDown(start.Add(edge.at))
+        } else {
+            decoder.keyUp(start.Add(edge.at))
+        }
+    }
+    decoder.idle(start.Add(edges[len(edges) - 1].at + time.Minute))
+    return text
+}
+
+
+
+/**
+ * The level of one frequency in some samples, by the Goertzel
+ * algorithm.
+ *
+ * @param   samples the samples
+ * @param   hz      the frequency
+ * @param   rate    the sample rate
+ * @return  float64 the amplitude of that frequency
+ */
+func goertzel(samples []float64, hz float64, rate int) float64 {
+    k := 2 * math.Cos(2 * math.Pi * hz / float64(rate))
+    var s1, s2 float64
+    for _, x := range samples {
+        s1, s2 = x + k * s1 - s2, s1
+    }
+    power := s1 * s1 + s2 * s2 - k * s1 * s2
+    return 2 * math.Sqrt(math.Max(0, power)) / float64(len(samples))
+}
+
+
+
+/**
+ * Find the pitch of the CW: the frequency with the most energy across
+ * the whole recording.
+ *
+ * @param   samples the audio
+ * @param   rate    the sample rate
+ * @return  float64 the pitch in Hz
+ */
+func findPitch(samples []float64, rate int) float64 {
+    block := int(pitchBlock.Seconds() * float64(rate))
+    best, bestLevel := pitchMinHz, -1.0
+    for hz := pitchMinHz; hz <= pitchMaxHz; hz += pitchStepHz {
+        var level float64
+        for at := 0; at + block <= len(samples); at += block {
+            level += goertzel(samples[at:at + block], hz, rate)
+        }
+        if level > bestLevel {
+            best, bestLevel = hz, level
+        }
+    }
+    return best
+}
+
+
+
+/**
+ * Find where a tone is keyed.
+ *
+ * The audio is cut into detectBlock blocks and the tone's level measured
+ * in each.  The threshold adapts as the signal fades and the noise
+ * changes: in the detectWindow around each block the quietest fifth of
+ * the blocks gives the noise level and the loudest twentieth the tone
+ * level, and a window whose tone is not detectSnr times its noise is
+ * taken to have no tone.
+ * The key goes down above detectOn of the way from noise to tone and up
+ * below detectOff, and must stay there detectHold blocks.
+ *
+ * @param   samples the audio
+ * @param   rate    the sample rate
+ * @param   hz      the pitch of the tone
+ * @return  []toneEdge  the key going down and up, in order
+ */
+func detectKeying(samples []float64, rate int, hz float64) []toneEdge {
+    block := int(detectBlock.Seconds() * float64(rate))
+    var levels []float64
+    for at := 0; at + block <= len(samples); at += block {
+        levels = append(levels, goertzel(samples[at:at + block], hz, rate))
+    }
+
+    window := int(detectWindow / detectBlock)
+    hop := int(detectHop / detectBlock)
+    var edges []toneEdge
+    keyIsDown := false
+    held := 0
+    var on, off float64
+    for i, level := range levels {
+        if 0 == i % hop {
+            on, off = thresholds(levels, i - window / 2, i + window / 2)
+        }
+        want := keyIsDown
+        if level > on {
+            want = true
+        } else if level < off {
+            want = false
+        }
+        if want == keyIsDown {
+            held = 0
+            continue
+        }
+        held++
+        if held >= detectHold {
+            keyIsDown = want
+            held = 0
+            edges = append(edges, toneEdge{at: time.Duration(i + 1 - detectHold) * detectBlock, down: want})
+        }
+    }
+    if keyIsDown {
+        edges = append(edges, toneEdge{at: time.Duration(len(levels)) * detectBlock, down: false})
+    }
+    return edges
+}
+
+
+
+// the key down and key up levels for the blocks from first to last
+func thresholds(levels []float64, first int, last int) (float64, float64) {
+    if first < 0 {
+        first = 0
+    }
+    if last > len(levels) {
+        last = len(levels)
+    }
+    sorted := append([]float64(nil), levels[first:last]...)
+    sort.Float64s(sorted)
+    noise := sorted[len(sorted) / 5]
+    tone := sorted[len(sorted) * 19 / 20]
+    if tone < detectSnr * noise || tone <= 0 {
+        return math.Inf(1), math.Inf(1)         // nothing here but noise
+    }
+    return noise + detectOn * (tone - noise), noise + detectOff * (tone - noise)
+}
+
+/* end of file */
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+
+
+/**
+ * Key some text as a session from one sender, with standard spacing.
+ *
+ * @param   text    what to send
+ * @param   wpm     sending speed
+ * @param   sender  the sender id
+ * @return  []sessionEvent  the key events, after a second of silence
+ */
+func keyedSession(t *testing.T, text string, wpm int, sender string) []sessionEvent {
+    elements, err := encodeMorse(text)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dit := wpmToDit(wpm)
+    at := time.Unix(1000, 0).Add(time.Second)
+    var events []sessionEvent
+    keyed := func(down bool) {
+        events = append(events, sessionEvent{Received: at, Sender: sender, Down: down,
+                                             SentUs: at.UnixNano() / int64(time.Microsecond)})
+    }
+    for _, element := range elements {
+        switch element {
+        case '.':
+            keyed(true)
+            at = at.Add(dit)
+            keyed(false)
+        case '-':
+            keyed(true)
+            at = at.Add(3 * dit)
+            keyed(false)
+        case ' ':
+            at = at.Add(dit)
+        }
+        at = at.Add(dit)
+    }
+    return append(events, sessionEvent{Received: at.Add(time.Second), Sender: sender,
+                                       SentUs: at.Add(time.Second).UnixNano() / int64(time.Microsecond)})
+}
+
+
+
+func TestExportedNoisyAudioDecodesToItsText(t *testing.T) {
+    const text = "CQ CQ DE NI7E K"
+    config := defaultAudioConfig()
+    config.Band = map[string]BandConditions{
+        "noisy": {Noise: 0.2, Qsb: 0.4, QsbPeriodSec: 3, JitterMs: 3},
+    }
+    config.Stations = map[string]StationVoice{"0001": {PitchHz: 650}}
+    path := filepath.Join(t.TempDir(), "noisy.wav")
+
+    sink, err := newWavSink(path, config.SampleRate, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    audio := newToneGenerator(config, sink, systemClock{})
+    audio.setChannel("noisy")
+    if _, err := exportSession(keyedSession(t, text, 20, "0001"), 1, 0, audio, sink); err != nil {
+        t.Fatal(err)
+    }
+    if err := sink.close(); err != nil {
+        t.Fatal(err)
+    }
+
+    samples, rate, err := readWav(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    pitch := findPitch(samples, rate)
+    if pitch < 640 || pitch > 660 {
+        t.Errorf("found the tone at %v Hz, want 650", pitch)
+    }
+    edges := detectKeying(samples, rate, pitch)
+    if 0 == len(edges) {
+        t.Fatal("no keying found")
+    }
+    if got := strings.TrimSpace(decodeEdges(edges, time.Unix(0, 0), 20)); got != text {
+        t.Errorf("decoded %q, want %q", got, text)
+    }
+}
+
+/* end of file */
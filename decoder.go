@@ -0,0 +1,250 @@
+package main
+
+import (
+    "strings"
+    "sync"
+    "time"
+)
+
+
+
+// prosigns the decoder reports by name because they are not characters
+var prosignTable = map[string]string{
+    "-.-.-":        "<KA>",
+    "...-.-":       "<SK>",
+    "........":     "<HH>",
+    "...---...":    "<SOS>",
+    "...-.":        "<SN>",
+    ".-...":        "<AS>",
+}
+
+
+
+// element patterns back to text, built from morseTable and prosignTable
+var morseDecodeTable = buildDecodeTable()
+
+func buildDecodeTable() map[string]string {
+    table := make(map[string]string)
+    for r, code := range morseTable {
+        table[code] = string(r)
+    }
+    for code, name := range prosignTable {
+        table[code] = name
+    }
+    return table
+}
+
+
+
+/**
+ * Turns key down / key up times into text.
+ *
+ * Marks shorter than two dits are dits, longer ones dahs.  The dit
+ * length follows the operator's speed as they send.  A gap of more
+ * than two dits ends a character and more than five dits ends a word.
+ * Characters are passed to 'emit' as they are completed, with " " for
+ * a word space; patterns with no meaning are emitted as "*".
+ *
+ * idle() must be called regularly so the last character is emitted
+ * when the operator stops sending.
+ */
+type morseDecoder struct {
+    mutex       sync.Mutex
+    dit         time.Duration   // current estimate of the dit length
+    minDit      time.Duration
+    maxDit      time.Duration
+    keyIsDown   bool
+    downAt      time.Time
+    upAt        time.Time
+    elements    string          // elements of the character being sent
+    wordOpen    bool            // characters have been emitted since the last word space
+    emit        func(text string)
+}
+
+
+
+/**
+ * Create a decoder.
+ *
+ * @param   wpm     expected sending speed, in words per minute
+ * @param   emit    called with each decoded character or word space
+ * @return  d       the decoder
+ */
+func newMorseDecoder(wpm int, emit func(text string)) *morseDecoder {
+    return &morseDecoder{
+        dit:    wpmToDit(wpm),
+        minDit: wpmToDit(60),
+        maxDit: wpmToDit(4),
+        emit:   emit,
+    }
+}
+
+
+
+/**
+ * Length of a dit at a speed, using the PARIS standard of 50 dits per
+ * word.
+ */
+func wpmToDit(wpm int) time.Duration {
+    if wpm < 1 {
+        wpm = 1
+    }
+    return time.Duration(1200/wpm) * time.Millisecond
+}
+
+
+
+/**
+ * The decoder's current speed estimate, in words per minute.
+ */
+func (d *morseDecoder) wpm() int {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    return int(1200 * time.Millisecond / d.dit)
+}
+
+
+
+/**
+ * Record the key going down.
+ *
+ * @param   at      when it happened
+ */
+func (d *morseDecoder) keyDown(at time.Time) {
+    d.mutex.Lock()
+    if d.keyIsDown {
+        d.mutex.Unlock()
+        return
+    }
+    var out []string
+    if !d.upAt.IsZero() {
+        out = d.gap(at.Sub(d.upAt))
+    }
+    d.keyIsDown = true
+    d.downAt = at
+    d.mutex.Unlock()
+
+    d.send(out)
+}
+
+
+
+/**
+ * Record the key coming up.
+ *
+ * @param   at      when it happened
+ */
+func (d *morseDecoder) keyUp(at time.Time) {
+    d.mutex.Lock()
+    defer d.mutex.Unlock()
+    if !d.keyIsDown {
+        return
+    }
+    d.keyIsDown = false
+    d.upAt = at
+
+    mark := at.Sub(d.downAt)
+    if mark < 2*d.dit {
+        d.elements += "."
+        d.adapt(mark)
+    } else {
+        d.elements += "-"
+        if mark < 5*d.dit {
+            d.adapt(mark / 3)               // a long hold says nothing about speed
+        }
+    }
+}
+
+
+
+/**
+ * Flush a finished character or word after a long enough gap.
+ * Scheduler task.
+ *
+ * @param   now     the current time
+ */
+func (d *morseDecoder) idle(now time.Time) {
+    d.mutex.Lock()
+    var out []string
+    if !d.keyIsDown && !d.upAt.IsZero() {
+        out = d.gap(now.Sub(d.upAt))
+        if len(out) > 0 && out[len(out)-1] == " " {
+            d.upAt = time.Time{}            // nothing more to flush until the key moves
+        }
+    }
+    d.mutex.Unlock()
+
+    d.send(out)
+}
+
+
+
+/**
+ * Work out what a gap of key up time ends.  The caller must hold the
+ * mutex.
+ */
+func (d *morseDecoder) gap(space time.Duration) []string {
+    var out []string
+    if space > 2*d.dit && d.elements != "" {
+        text, ok := morseDecodeTable[d.elements]
+        if !ok {
+            text = "*"
+        }
+        out = append(out, text)
+        d.elements = ""
+        d.wordOpen = true
+    }
+    if space > 5*d.dit && d.wordOpen {
+        out = append(out, " ")
+        d.wordOpen = false
+    }
+    return out
+}
+
+
+
+// move the dit estimate a fifth of the way towards a new measurement
+func (d *morseDecoder) adapt(measured time.Duration) {
+    d.dit = (4*d.dit + measured) / 5
+    if d.dit < d.minDit {
+        d.dit = d.minDit
+    }
+    if d.dit > d.maxDit {
+        d.dit = d.maxDit
+    }
+}
+
+
+
+func (d *morseDecoder) send(out []string) {
+    for _, text := range out {
+        d.emit(text)
+    }
+}
+
+
+
+/**
+ * Decode a whole element string such as ".- -..." back to text.  Used
+ * to check the decoder against the encoder.
+ *
+ * @param   elements    letters separated by one space, words by three
+ * @return  string      the decoded text
+ */
+func decodeElements(elements string) string {
+    var words []string
+    for _, word := range strings.Split(elements, "   ") {
+        var text string
+        for _, letter := range strings.Fields(word) {
+            if decoded, ok := morseDecodeTable[letter]; ok {
+                text += decoded
+            } else {
+                text += "*"
+            }
+        }
+        words = append(words, text)
+    }
+    return strings.Join(words, " ")
+}
+
+/* end of file */
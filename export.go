@@ -0,0 +1,152 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "time"
+)
+
+
+
+// silence left after the last key up, so it rings out
+const exportTail = 500 * time.Millisecond
+
+
+
+/**
+ * Render a recorded session to a WAV file with the software audio
+ * settings: every sender mixed in, each in its own voice.
+ *
+ *      telegraph-tool export [-config config.json] [-o session.wav] [-speed 1]
+ *                            [-seek 0s] [-channel name] [-sender id] [-band name] session.log
+ *
+ * @param   args    the command line after "export"
+ * @return  error   set if the session could not be exported
+ */
+func exportCommand(args []string) error {
+    flags := flag.NewFlagSet("export", flag.ContinueOnError)
+    configPath := flags.String("config", "config.json", "telegraph config file with the audio settings")
+    path := flags.String("o", "session.wav", "WAV file to write")
+    speed := flags.Float64("speed", 1, "playback speed, 2 for twice as fast")
+    seek := flags.Duration("seek", 0, "start this far into the session, e.g. 1m30s")
+    channel := flags.String("channel", "", "only export events recorded on this channel")
+    sender := flags.String("sender", "", "only export events from this sender id")
+    band := flags.String("band", "", "add the band conditions configured for this channel")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if flags.NArg() != 1 {
+        return errors.New("give one session log to export")
+    }
+    if *speed <= 0 {
+        return errors.New("speed must be more than 0")
+    }
+    config, err := loadToolConfig(*configPath)
+    if err != nil {
+        return err
+    }
+    events, err := readSession(flags.Arg(0))
+    if err != nil {
+        return err
+    }
+    events = selectEvents(events, *channel, *sender)
+    if 0 == len(events) {
+        return errors.New("no key events to export")
+    }
+
+    sink, err := newWavSink(*path, config.Audio.SampleRate, audioChannels(config.Audio))
+    if err != nil {
+        return err
+    }
+    audio := newToneGenerator(config.Audio, sink, systemClock{})
+    audio.setChannel(*band)
+    length, err := exportSession(events, *speed, *seek, audio, sink)
+    if closeErr := sink.close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        return err
+    }
+    fmt.Println("Wrote", length.Round(time.Millisecond), "of audio to", *path)
+    return nil
+}
+
+
+
+/**
+ * Render the events as fast as the samples can be made, timed by their
+ * senders' timestamps as senderTiming() gives them.  Band
+ * conditions on the generator also move each event by their jitter,
+ * never past the sender's event before it.
+ *
+ * @param   events  the session, in the order recorded
+ * @param   speed   playback speed, 1 for the original timing
+ * @param   seek    how far into the session to start
+ * @param   audio   the generator, keyed here and never run()
+ * @param   sink    where the samples go
+ * @return  time.Duration   length of the audio written
+ * @return  error   set if the sink failed
+ */
+func exportSession(events []sessionEvent, speed float64, seek time.Duration,
+                   audio *toneGenerator, sink pcmSink) (time.Duration, error) {
+    rate := float64(audio.config.SampleRate)
+    channels := audio.config.Channels
+    block := make([]int16, channels * int(rate * audioBlock.Seconds()))
+    written := 0                                // frames
+    last := make(map[string]int)                // frame of each sender's last event
+
+    // render up to a frame, in blocks
+    renderTo := func(frame int) error {
+        for written < frame {
+            n := frame - written
+            if n > len(block) / channels {
+                n = len(block) / channels
+            }
+            audio.render(block[:n * channels])
+            if err := sink.write(block[:n * channels]); err != nil {
+                return err
+            }
+            written += n
+        }
+        return nil
+    }
+
+    timed := senderTiming(events)
+    from := timed[0].at.Add(seek)
+    down := make(map[string]bool)
+    for _, e := range timed {
+        if e.at.Before(from) {
+            continue
+        }
+        at := time.Duration(float64(e.at.Sub(from)) / speed) + audio.jitter()
+        frame := int(at.Seconds() * rate)
+        if previous, ok := last[e.Sender]; ok && frame <= previous {
+            frame = previous + 1
+        }
+        if frame < written {
+            frame = written                     // jitter cannot go back in time
+        }
+        last[e.Sender] = frame
+        if err := renderTo(frame); err != nil {
+            return 0, err
+        }
+        if SENDER_LOCAL == e.Sender {
+            audio.key(e.Down)
+        } else {
+            audio.keyStation(e.Sender, e.Down)
+        }
+        down[e.Sender] = e.Down
+    }
+    for sender, isDown := range down {
+        if isDown && SENDER_LOCAL == sender {
+            audio.key(false)
+        } else if isDown {
+            audio.keyStation(sender, false)
+        }
+    }
+    err := renderTo(written + int(exportTail.Seconds() * rate))
+    return time.Duration(float64(written) / rate * float64(time.Second)), err
+}
+
+/* end of file */
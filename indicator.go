@@ -0,0 +1,386 @@
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net"
+    "sync"
+    "time"
+
+    "github.com/stianeikeland/go-rpio"
+)
+
+
+
+// indicator modes, each shown with its own blink pattern
+const(
+    LED_BOOTING     = "booting"
+    LED_NO_NETWORK  = "no network"
+    LED_NO_SERVER   = "no server"
+    LED_IDLE        = "connected idle"
+    LED_RECEIVING   = "receiving"
+    )
+
+// how long the LED keeps following remote keying after the last message
+const receiveHold = 2 * time.Second
+
+
+
+/**
+ * Blink patterns, as alternating on and off times starting with on.  A
+ * single entry means solid on.  LED_RECEIVING has no pattern; the LED
+ * follows the remote key instead.
+ */
+var ledPatterns = map[string][]time.Duration{
+    LED_BOOTING:    {time.Second},
+    LED_NO_NETWORK: {1000 * time.Millisecond, 1000 * time.Millisecond},
+    LED_NO_SERVER:  {150 * time.Millisecond, 150 * time.Millisecond,
+                     150 * time.Millisecond, 1550 * time.Millisecond},
+    LED_IDLE:       {50 * time.Millisecond, 2950 * time.Millisecond},
+}
+
+
+
+/**
+ * Indicator LED settings, read from the "indicator" section of
+ * config.json.  Backend is "sysfs", "gpio" or "off".
+ */
+type IndicatorConfig struct {
+    Backend     string      `json:"backend"`
+    Path        string      `json:"path"`       // sysfs LED directory
+    Pin         int         `json:"pin"`        // BCM pin number for the gpio backend
+    ActiveLow   bool        `json:"activeLow"`
+}
+
+
+
+func defaultIndicatorConfig() IndicatorConfig {
+    return IndicatorConfig{Backend: "sysfs", Path: "/sys/class/leds/led0"}
+}
+
+
+
+// something that can turn an LED on and off
+type ledBackend interface {
+    set(on bool) error
+}
+
+
+
+/**
+ * Create the LED backend described by the configuration.
+ *
+ * @param   config  indicator settings
+ * @return  backend the LED backend, one that does nothing when the
+ *                  indicator is off
+ */
+func newLEDBackend(config IndicatorConfig) ledBackend {
+    switch config.Backend {
+    case "sysfs":
+        return newSysfsLED(config.Path)
+    case "gpio":
+        return newGpioLED(config.Pin, config.ActiveLow)
+    case "off":
+    default:
+        fmt.Println("indicator: unknown backend", config.Backend, "- indicator off")
+    }
+    return offLED{}
+}
+
+
+
+// LED controlled through /sys/class/leds, such as the Pi's ACT LED
+type sysfsLED struct {
+    path    string
+}
+
+
+
+/**
+ * Take control of a sysfs LED.  The LED's trigger is switched to "none"
+ * so the kernel does not fight over it.
+ *
+ * @param   path    sysfs LED directory, e.g. /sys/class/leds/led0
+ * @return  led     the LED backend
+ */
+func newSysfsLED(path string) *sysfsLED {
+    if err := ioutil.WriteFile(path+"/trigger", []byte("none"), 0644); err != nil {
+        fmt.Println("Error taking over LED:", err)
+    }
+    return &sysfsLED{path: path}
+}
+
+func (l *sysfsLED) set(on bool) error {
+    value := "0"
+    if on {
+        value = "1"
+    }
+    return ioutil.WriteFile(l.path+"/brightness", []byte(value), 0644)
+}
+
+
+
+// LED wired to a GPIO pin; rpio must already be open
+type gpioLED struct {
+    pin         rpio.Pin
+    activeLow   bool
+}
+
+func newGpioLED(bcm int, activeLow bool) *gpioLED {
+    l := &gpioLED{pin: rpio.Pin(bcm), activeLow: activeLow}
+    l.pin.Output()
+    return l
+}
+
+func (l *gpioLED) set(on bool) error {
+    if on != l.activeLow {
+        l.pin.Write(rpio.High)
+    } else {
+        l.pin.Write(rpio.Low)
+    }
+    return nil
+}
+
+
+
+// LED backend for a turned off indicator; ignores every write
+type offLED struct{}
+
+func (offLED) set(on bool) error {
+    return nil
+}
+
+
+
+/**
+ * Drives a status LED with a blink pattern for the current mode.
+ *
+ * tick() must be called regularly, normally as a scheduler task.  All
+ * timing comes from the clock, so a fakeClock and a backend that records
+ * its writes can be used to check the patterns.
+ */
+type indicator struct {
+    backend     ledBackend
+    clock       clock
+
+    mutex       sync.Mutex
+    mode        string
+    modeStart   time.Time
+    remoteOn    bool
+    lastRemote  time.Time
+    flashing    bool
+    lit         bool
+    written     bool            // lit has been written to the backend
+}
+
+
+
+/**
+ * Create an indicator, starting in LED_BOOTING mode.
+ *
+ * @param   backend the LED to drive
+ * @param   c       clock used to time the patterns
+ * @return  ind     the indicator
+ */
+func newIndicator(backend ledBackend, c clock) *indicator {
+    ind := &indicator{backend: backend, clock: c}
+    ind.setMode(LED_BOOTING)
+    return ind
+}
+
+
+
+/**
+ * Switch to a different LED, turning the old one off.
+ *
+ * @param   backend the LED to drive from now on
+ */
+func (ind *indicator) setBackend(backend ledBackend) {
+    ind.mutex.Lock()
+    old := ind.backend
+    ind.backend = backend
+    ind.written = false
+    ind.mutex.Unlock()
+    old.set(false)
+}
+
+
+
+/**
+ * Change the pattern shown.  Setting the current mode again does not
+ * restart its pattern.
+ *
+ * @param   mode    one of the LED_* modes
+ */
+func (ind *indicator) setMode(mode string) {
+    ind.mutex.Lock()
+    defer ind.mutex.Unlock()
+    if mode != ind.mode {
+        fmt.Println("indicator:", mode)
+        ind.mode = mode
+        ind.modeStart = ind.clock.now()
+    }
+}
+
+
+
+/**
+ * Report remote keying.  While connected, the LED follows the remote key
+ * until receiveHold has passed without traffic.
+ *
+ * @param   on      true for key down
+ */
+func (ind *indicator) remoteKey(on bool) {
+    ind.mutex.Lock()
+    ind.remoteOn = on
+    ind.lastRemote = ind.clock.now()
+    ind.mutex.Unlock()
+}
+
+
+
+/**
+ * Update the LED.  Scheduler task.
+ */
+func (ind *indicator) tick() {
+    ind.mutex.Lock()
+    if ind.flashing {
+        ind.mutex.Unlock()
+        return
+    }
+    now := ind.clock.now()
+    mode := ind.mode
+    if LED_IDLE == mode && now.Sub(ind.lastRemote) < receiveHold {
+        mode = LED_RECEIVING
+    }
+
+    var on bool
+    if LED_RECEIVING == mode {
+        on = ind.remoteOn
+    } else {
+        on = patternState(ledPatterns[mode], now.Sub(ind.modeStart))
+    }
+    ind.mutex.Unlock()
+
+    ind.write(on)
+}
+
+
+
+/**
+ * Work out whether a pattern has the LED on at a point in its cycle.
+ *
+ * @param   pattern alternating on and off times
+ * @param   elapsed time since the pattern started
+ * @return  bool    true if the LED is on
+ */
+func patternState(pattern []time.Duration, elapsed time.Duration) bool {
+    if len(pattern) == 0 {
+        return false
+    }
+    if len(pattern) == 1 {
+        return true
+    }
+    var cycle time.Duration
+    for _, d := range pattern {
+        cycle += d
+    }
+    position := elapsed % cycle
+    for i, d := range pattern {
+        if position < d {
+            return i%2 == 0
+        }
+        position -= d
+    }
+    return false
+}
+
+
+
+func (ind *indicator) write(on bool) {
+    ind.mutex.Lock()
+    changed := !ind.written || on != ind.lit
+    ind.lit = on
+    ind.written = true
+    backend := ind.backend
+    ind.mutex.Unlock()
+
+    if changed {
+        if err := backend.set(on); err != nil {
+            fmt.Println("Error setting LED:", err)
+        }
+    }
+}
+
+
+
+/**
+ * Flash Morse elements on the LED, pausing the blink pattern.  Returns
+ * when the elements have been shown.
+ *
+ * @param   elements    '.', '-' and ' ' elements to flash
+ * @param   ditTime     length of one dit
+ */
+func (ind *indicator) flash(elements string, ditTime time.Duration) {
+    ind.mutex.Lock()
+    ind.flashing = true
+    ind.mutex.Unlock()
+
+    for i := 0; i < len(elements); i++ {
+        switch elements[i] {
+        case '.':
+            ind.write(true)
+            ind.clock.sleep(ditTime)
+        case '-':
+            ind.write(true)
+            ind.clock.sleep(3 * ditTime)
+        case ' ':
+            ind.clock.sleep(ditTime)
+        }
+        ind.write(false)
+        ind.clock.sleep(ditTime)
+    }
+
+    ind.mutex.Lock()
+    ind.flashing = false
+    ind.mutex.Unlock()
+}
+
+
+
+/**
+ * Turn the LED off for good, e.g. at shutdown.
+ */
+func (ind *indicator) off() {
+    ind.mutex.Lock()
+    ind.flashing = true
+    ind.mutex.Unlock()
+    ind.write(false)
+}
+
+
+
+/**
+ * Report whether this machine has a usable network address.  Used to
+ * tell "no network" apart from "no server".
+ */
+func haveNetwork() bool {
+    interfaces, err := net.Interfaces()
+    if err != nil {
+        return false
+    }
+    for _, iface := range interfaces {
+        if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+            continue
+        }
+        addrs, _ := iface.Addrs()
+        for _, addr := range addrs {
+            if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+/* end of file */
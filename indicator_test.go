@@ -0,0 +1,121 @@
+package main
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+
+
+// LED that remembers what it was told, so the patterns can be checked
+type fakeLED struct {
+    mutex   sync.Mutex
+    on      bool
+    history []bool
+}
+
+func (l *fakeLED) set(on bool) error {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    l.on = on
+    l.history = append(l.history, on)
+    return nil
+}
+
+func (l *fakeLED) isOn() bool {
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    return l.on
+}
+
+
+
+// an indicator in a mode on a fake LED and clock
+func newTestIndicator(mode string) (*indicator, *fakeLED, *fakeClock) {
+    led := &fakeLED{}
+    fc := newFakeClock(time.Unix(1000, 0))
+    ind := newIndicator(led, fc)
+    ind.setMode(mode)
+    return ind, led, fc
+}
+
+
+
+func TestIndicatorShowsEachModesPattern(t *testing.T) {
+    for mode, pattern := range ledPatterns {
+        ind, led, fc := newTestIndicator(mode)
+        var elapsed time.Duration
+        for i, d := range pattern {
+            ind.tick()
+            if want := 0 == i % 2 || 1 == len(pattern); led.isOn() != want {
+                t.Errorf("%s: LED on %v at %v, want %v", mode, led.isOn(), elapsed, want)
+            }
+            fc.advance(d)
+            elapsed += d
+        }
+    }
+}
+
+
+
+func TestIndicatorFollowsRemoteKeyingWhileIdle(t *testing.T) {
+    ind, led, fc := newTestIndicator(LED_IDLE)
+    fc.advance(100 * time.Millisecond)          // past the idle blink
+
+    ind.remoteKey(true)
+    ind.tick()
+    if !led.isOn() {
+        t.Error("LED off while the remote key is down")
+    }
+    ind.remoteKey(false)
+    ind.tick()
+    if led.isOn() {
+        t.Error("LED on after the remote key went up")
+    }
+
+    fc.advance(receiveHold)
+    ind.setMode(LED_NO_SERVER)
+    ind.tick()
+    if !led.isOn() {
+        t.Error("no server pattern not shown after the receive hold")
+    }
+}
+
+
+
+func TestIndicatorFlashesElements(t *testing.T) {
+    ind, led, fc := newTestIndicator(LED_IDLE)
+    fc.advance(100 * time.Millisecond)          // past the idle blink, so the LED is off
+    ind.tick()
+    led.history = nil
+    start := fc.now()
+
+    ind.flash(".-", 10 * time.Millisecond)
+    want := []bool{true, false, true, false}
+    if len(led.history) != len(want) {
+        t.Fatalf("flash wrote %v, want %v", led.history, want)
+    }
+    for i := range want {
+        if led.history[i] != want[i] {
+            t.Fatalf("flash wrote %v, want %v", led.history, want)
+        }
+    }
+    if took := fc.now().Sub(start); took != 60 * time.Millisecond {
+        t.Errorf("flash took %v, want 60ms", took)
+    }
+}
+
+
+
+func TestIndicatorOffBackendIgnoresWrites(t *testing.T) {
+    backend := newLEDBackend(IndicatorConfig{Backend: "off"})
+    if _, ok := backend.(offLED); !ok {
+        t.Fatalf("off backend is %T, want offLED", backend)
+    }
+    if err := backend.set(true); err != nil {
+        t.Error(err)
+    }
+}
+
+/* end of file */
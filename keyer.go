@@ -0,0 +1,288 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+
+
+// what the key input is connected to
+const(
+    KM_STRAIGHT     = "straight"    // straight key or external keyer on the key pin
+    KM_BUG          = "bug"         // automatic dits, manual dahs
+    KM_IAMBIC_A     = "iambicA"     // squeeze keying, stops when the paddles are released
+    KM_IAMBIC_B     = "iambicB"     // squeeze keying, adds one more element after a squeeze
+    )
+
+
+
+/**
+ * Key and keyer settings, read from the "keyer" section of config.json.
+ * With a paddle the dit lever is wired to the key pin and the dah lever
+ * to DahPin.
+ */
+type KeyerConfig struct {
+    Mode    string  `json:"mode"`       // one of the KM_* modes
+    DahPin  int     `json:"dahPin"`     // BCM number of the dah lever input
+    Wpm     int     `json:"wpm"`        // speed of generated elements
+    Memory  bool    `json:"memory"`     // remember a lever tapped during an element
+}
+
+
+
+func defaultKeyerConfig() KeyerConfig {
+    return KeyerConfig{Mode: KM_STRAIGHT, DahPin: 8, Wpm: 18, Memory: true}
+}
+
+
+
+/**
+ * Turns the state of the key or paddle levers into key down and key up
+ * events.
+ *
+ * In straight mode the dit lever is passed through unchanged.  In bug
+ * mode the dit lever sends a string of dits and the dah lever is passed
+ * through.  In the iambic modes each lever sends its element for as
+ * long as it is held and squeezing both alternates them.  A lever
+ * closed while the other element is sounding is remembered and sent
+ * next when memory is on; one already held when the element started is
+ * not.  Mode B sends one more, opposite, element if
+ * both levers were squeezed during an element and are released before
+ * it ends; mode A just stops.
+ *
+ * levers() must be called often, every couple of milliseconds, for the
+ * elements to be timed accurately.  Elements are timed from when they
+ * should have started, not when levers() was called, so lateness does not
+ * build up.  All times come from the clock so the keyer runs
+ * deterministically under a fakeClock.
+ */
+type keyer struct {
+    clock       clock
+    output      func(down bool, at time.Time)
+
+    mutex       sync.Mutex
+    config      KeyerConfig
+    dit         time.Duration
+    ditLever    bool
+    dahLever    bool
+    ditMemory   bool
+    dahMemory   bool
+    squeezed    bool            // both levers were down during the current element
+    ditWas      bool            // lever states when remember() last looked
+    dahWas      bool
+    element     byte            // '.' or '-' being sent, 0 when idle
+    keyIsDown   bool            // output state
+    markEnd     time.Time       // when the current element's mark ends
+    spaceEnd    time.Time       // when the space after it ends
+}
+
+
+
+/**
+ * Create a keyer.
+ *
+ * @param   config  keyer settings
+ * @param   c       clock used to time elements
+ * @param   output  called with each key down (true) and key up (false)
+ *                  and when it happened
+ * @return  k       the keyer
+ */
+func newKeyer(config KeyerConfig, c clock, output func(down bool, at time.Time)) *keyer {
+    k := &keyer{clock: c, output: output}
+    k.setConfig(config)
+    return k
+}
+
+
+
+/**
+ * Change the keyer settings.  An element being sent is finished at the
+ * old speed.
+ */
+func (k *keyer) setConfig(config KeyerConfig) {
+    k.mutex.Lock()
+    defer k.mutex.Unlock()
+    k.config = config
+    k.dit = wpmToDit(config.Wpm)
+    k.ditMemory, k.dahMemory = false, false
+    fmt.Println("keyer:", config.Mode, config.Wpm, "WPM")
+}
+
+
+
+/**
+ * Report whether the keyer reads the dah lever.
+ */
+func (k *keyer) usesDahLever() bool {
+    k.mutex.Lock()
+    defer k.mutex.Unlock()
+    return KM_STRAIGHT != k.config.Mode
+}
+
+
+
+/**
+ * Take the lever states and send whatever they call for.
+ *
+ * @param   dit     true while the dit lever (or straight key) is closed
+ * @param   dah     true while the dah lever is closed
+ */
+func (k *keyer) levers(dit, dah bool) {
+    k.mutex.Lock()
+    k.ditLever, k.dahLever = dit, dah
+    var events []keyEvent
+    switch k.config.Mode {
+    case KM_STRAIGHT:
+        events = k.passThrough(dit)
+    case KM_BUG:
+        if 0 == k.element {
+            events = k.passThrough(dah && !dit)     // dahs are made by hand
+        }
+        if 0 != k.element || (dit && !k.keyIsDown) {
+            events = append(events, k.step()...)
+        }
+    default:
+        events = k.step()
+    }
+    k.mutex.Unlock()
+
+    for _, e := range events {
+        k.output(e.down, e.at)
+    }
+}
+
+
+
+// a key down or key up produced by the keyer
+type keyEvent struct {
+    down    bool
+    at      time.Time
+}
+
+
+
+// follow a contact directly; the caller must hold the mutex
+func (k *keyer) passThrough(closed bool) []keyEvent {
+    if closed == k.keyIsDown {
+        return nil
+    }
+    k.keyIsDown = closed
+    return []keyEvent{{closed, k.clock.now()}}
+}
+
+
+
+/**
+ * Run the element timing up to the current time.  The caller must
+ * hold the mutex.
+ */
+func (k *keyer) step() []keyEvent {
+    var events []keyEvent
+    now := k.clock.now()
+
+    for {
+        if 0 != k.element {
+            k.remember()
+            if k.keyIsDown {
+                if now.Before(k.markEnd) {
+                    return events
+                }
+                k.keyIsDown = false
+                events = append(events, keyEvent{false, k.markEnd})
+            }
+            if now.Before(k.spaceEnd) {
+                return events
+            }
+        }
+
+        next := k.nextElement()
+        if 0 == next {
+            k.element = 0
+            k.squeezed = false
+            return events
+        }
+
+        start := now
+        if 0 != k.element {
+            start = k.spaceEnd                  // follow on without a gap
+        }
+        length := k.dit
+        if '-' == next {
+            length = 3 * k.dit
+        }
+        k.element = next
+        k.squeezed = k.ditLever && k.dahLever
+        k.ditWas, k.dahWas = k.ditLever, k.dahLever
+        k.keyIsDown = true
+        k.markEnd = start.Add(length)
+        k.spaceEnd = k.markEnd.Add(k.dit)
+        events = append(events, keyEvent{true, start})
+    }
+}
+
+
+
+/**
+ * Note levers closed while an element is being sent.  Only a lever
+ * that was open and has closed is remembered; the caller must hold the
+ * mutex.
+ */
+func (k *keyer) remember() {
+    if k.ditLever && k.dahLever {
+        k.squeezed = true
+    }
+    ditClosed := k.ditLever && !k.ditWas
+    dahClosed := k.dahLever && !k.dahWas
+    k.ditWas, k.dahWas = k.ditLever, k.dahLever
+    if !k.config.Memory || KM_BUG == k.config.Mode {
+        return
+    }
+    if '-' == k.element && ditClosed {
+        k.ditMemory = true
+    }
+    if '.' == k.element && dahClosed {
+        k.dahMemory = true
+    }
+}
+
+
+
+/**
+ * Choose the element to send after the current one, or 0 to stop.
+ * The caller must hold the mutex.
+ */
+func (k *keyer) nextElement() byte {
+    if KM_BUG == k.config.Mode {
+        if k.ditLever {
+            return '.'
+        }
+        return 0
+    }
+
+    dit := k.ditLever || k.ditMemory
+    dah := k.dahLever || k.dahMemory
+    k.ditMemory, k.dahMemory = false, false
+
+    var next byte
+    switch {
+    case dit && dah:
+        next = '.'                              // squeeze: alternate, dit first
+        if '.' == k.element {
+            next = '-'
+        }
+    case dit:
+        next = '.'
+    case dah:
+        next = '-'
+    case KM_IAMBIC_B == k.config.Mode && k.squeezed:
+        next = '.'                              // squeeze released: one more opposite element
+        if '.' == k.element {
+            next = '-'
+        }
+    }
+    return next
+}
+
+/* end of file */
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "testing"
+    "time"
+)
+
+
+
+// the levers as they are from a time, in milliseconds, onwards
+type leverChange struct {
+    at      int
+    dit     bool
+    dah     bool
+}
+
+
+
+/**
+ * Run a keyer at 20 WPM, a 60 ms dit, on a fake clock, polling the
+ * levers every millisecond.
+ *
+ * @param   config  keyer settings; the speed is overridden
+ * @param   changes lever changes in time order
+ * @param   length  how long to run, in milliseconds
+ * @return  events  key changes as "true@0", with times in milliseconds
+ */
+func runKeyer(config KeyerConfig, changes []leverChange, length int) []string {
+    start := time.Unix(1000, 0)
+    fc := newFakeClock(start)
+    var events []string
+    config.Wpm = 20
+    k := newKeyer(config, fc, func(down bool, at time.Time) {
+        events = append(events, fmt.Sprintf("%v@%d", down, at.Sub(start) / time.Millisecond))
+    })
+
+    var dit, dah bool
+    for ms := 0; ms <= length; ms++ {
+        for _, change := range changes {
+            if change.at == ms {
+                dit, dah = change.dit, change.dah
+            }
+        }
+        k.levers(dit, dah)
+        fc.advance(time.Millisecond)
+    }
+    return events
+}
+
+
+
+func checkKeying(t *testing.T, name string, got, want []string) {
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("%s: keyed %v, want %v", name, got, want)
+    }
+}
+
+
+
+func TestKeyerStraightFollowsTheKey(t *testing.T) {
+    got := runKeyer(KeyerConfig{Mode: KM_STRAIGHT},
+        []leverChange{{10, true, false}, {45, false, false}, {100, true, true}, {130, false, true}}, 200)
+    checkKeying(t, "straight", got, []string{"true@10", "false@45", "true@100", "false@130"})
+}
+
+
+
+func TestKeyerBugSendsDitsAndHandMadeDahs(t *testing.T) {
+    got := runKeyer(KeyerConfig{Mode: KM_BUG},
+        []leverChange{{0, true, false}, {150, false, false}, {300, false, true}, {420, false, false}}, 500)
+    checkKeying(t, "bug", got, []string{"true@0", "false@60", "true@120", "false@180",
+                                        "true@300", "false@420"})
+}
+
+
+
+func TestKeyerIambicModesDifferAfterASqueeze(t *testing.T) {
+    // squeeze, then let go of both levers while the dah is sounding
+    squeeze := []leverChange{{0, true, true}, {200, false, false}}
+
+    got := runKeyer(KeyerConfig{Mode: KM_IAMBIC_A, Memory: true}, squeeze, 600)
+    checkKeying(t, "iambic A", got, []string{"true@0", "false@60", "true@120", "false@300"})
+
+    got = runKeyer(KeyerConfig{Mode: KM_IAMBIC_B, Memory: true}, squeeze, 600)
+    checkKeying(t, "iambic B", got, []string{"true@0", "false@60", "true@120", "false@300",
+                                             "true@360", "false@420"})
+}
+
+
+
+func TestKeyerRemembersALeverClosedDuringAnElement(t *testing.T) {
+    // a dit, with the dah lever tapped while it sounds
+    tap := []leverChange{{0, true, false}, {10, false, false}, {20, false, true}, {30, false, false}}
+
+    got := runKeyer(KeyerConfig{Mode: KM_IAMBIC_A, Memory: true}, tap, 500)
+    checkKeying(t, "memory on", got, []string{"true@0", "false@60", "true@120", "false@300"})
+
+    got = runKeyer(KeyerConfig{Mode: KM_IAMBIC_A, Memory: false}, tap, 500)
+    checkKeying(t, "memory off", got, []string{"true@0", "false@60"})
+}
+
+/* end of file */
@@ -0,0 +1,94 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "unicode"
+)
+
+
+
+// International Morse code for the characters the encoder understands
+var morseTable = map[rune]string{
+    'A': ".-",      'B': "-...",    'C': "-.-.",    'D': "-..",
+    'E': ".",       'F': "..-.",    'G': "--.",     'H': "....",
+    'I': "..",      'J': ".---",    'K': "-.-",     'L': ".-..",
+    'M': "--",      'N': "-.",      'O': "---",     'P': ".--.",
+    'Q': "--.-",    'R': ".-.",     'S': "...",     'T': "-",
+    'U': "..-",     'V': "...-",    'W': ".--",     'X': "-..-",
+    'Y': "-.--",    'Z': "--..",
+    '0': "-----",   '1': ".----",   '2': "..---",   '3': "...--",
+    '4': "....-",   '5': ".....",   '6': "-....",   '7': "--...",
+    '8': "---..",   '9': "----.",
+    '.': ".-.-.-",  ',': "--..--",  '?': "..--..",  '/': "-..-.",
+    '=': "-...-",   '+': ".-.-.",   '-': "-....-",  '@': ".--.-.",
+    '\'': ".----.", '(': "-.--.",   ')': "-.--.-",  ':': "---...",
+    '"': ".-..-.",
+}
+
+
+
+/**
+ * Encode text into the element string played by playMorseElements().
+ *
+ * Letters are separated by a single space and words by three spaces,
+ * which gives standard letter and word spacing when played.  Letters
+ * inside angle brackets are run together to form a prosign, so "<AR>"
+ * encodes as ".-.-.".  Text made only of '.', '-' and spaces is taken to
+ * be elements already and is returned unchanged.
+ *
+ * @param   text    the message to encode
+ * @return  string  the encoded elements
+ * @return  error   set if the text contains a character with no code
+ */
+func encodeMorse(text string) (string, error) {
+    if isMorseElements(text) {
+        return text, nil
+    }
+
+    var words []string
+    for _, word := range strings.Fields(strings.ToUpper(text)) {
+        var letters []string
+        prosign := ""
+        inProsign := false
+        for _, r := range word {
+            switch {
+            case r == '<' && !inProsign:
+                inProsign = true
+                prosign = ""
+            case r == '>' && inProsign:
+                inProsign = false
+                letters = append(letters, prosign)
+            default:
+                code, ok := morseTable[unicode.ToUpper(r)]
+                if !ok {
+                    return "", fmt.Errorf("no Morse code for %q in %q", r, text)
+                }
+                if inProsign {
+                    prosign += code
+                } else {
+                    letters = append(letters, code)
+                }
+            }
+        }
+        if inProsign {
+            return "", fmt.Errorf("unterminated prosign in %q", text)
+        }
+        words = append(words, strings.Join(letters, " "))
+    }
+    return strings.Join(words, "   "), nil
+}
+
+
+
+/**
+ * Report whether a string is already made of Morse elements.
+ */
+func isMorseElements(text string) bool {
+    if strings.TrimSpace(text) == "" {
+        return false
+    }
+    return strings.Trim(text, ".- ") == ""
+}
+
+/* end of file */
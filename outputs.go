@@ -0,0 +1,280 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+
+
+// what drives an output pin
+const(
+    OUT_SOUNDER     = "sounder"     // the sounder as decided by the break-in policy
+    OUT_LOCAL       = "local"       // side tone for the local key only
+    OUT_REMOTE      = "remote"      // keying received from the channel only
+    OUT_STATUS      = "status"      // status signals and command replies only
+    )
+
+
+
+/**
+ * One output pin, read from the "outputs" list in config.json.
+ */
+type OutputConfig struct {
+    Pin         int     `json:"pin"`        // BCM pin number
+    ActiveLow   bool    `json:"activeLow"`  // the pin is pulled low to sound
+    Source      string  `json:"source"`     // one of the OUT_* sources
+    Channel     string  `json:"channel"`    // with the remote source, only while on this channel
+    PullInMs    float64 `json:"pullInMs"`   // how long the sounder takes to pull in
+    ReleaseMs   float64 `json:"releaseMs"`  // how long the sounder takes to release
+    SensePin    int     `json:"sensePin"`   // BCM input closed by the armature, for -calibrate; 0 for none
+    ToneHz      int     `json:"toneHz"`     // hardware PWM tone for a passive piezo, 0 for on/off
+    Duty        float64 `json:"duty"`       // PWM duty cycle, 0 for 0.5
+}
+
+
+
+// the drive delay that lines up the clicks of every compensated output
+func compensationDelay(outputs []OutputConfig) time.Duration {
+    var most float64
+    for _, output := range outputs {
+        if output.PullInMs > most {
+            most = output.PullInMs
+        }
+        if output.ReleaseMs > most {
+            most = output.ReleaseMs
+        }
+    }
+    return time.Duration(most * float64(time.Millisecond))
+}
+
+
+
+// whether any of the outputs drives a pin
+func outputUsesPin(outputs []OutputConfig, pin int) bool {
+    for _, output := range outputs {
+        if output.Pin == pin {
+            return true
+        }
+    }
+    return false
+}
+
+
+
+/**
+ * The outputs the client has always driven: the sounder driver on BCM
+ * 10, active high, and on BCM 27, active low.
+ */
+func defaultOutputs() []OutputConfig {
+    return []OutputConfig{
+        {Pin: spkrPinBCM,  Source: OUT_SOUNDER},
+        {Pin: spkrPinBCML, Source: OUT_SOUNDER, ActiveLow: true},
+    }
+}
+
+
+
+/**
+ * Drives each output pin from its own source, so a relay sounder can
+ * click only for the channel while a piezo gives the side tone.  A pin
+ * listed more than once is on while any of its sources is.  rpio must
+ * already be open.
+ *
+ * Remote keying is played through a short delay so each output's pull
+ * in and release time can be taken off its drive edges: an output is
+ * driven PullInMs before the key down click is due and ReleaseMs before
+ * the key up click, so every sounder clicks when the remote key moved,
+ * all delayed by the same amount.  An element too short to fit between
+ * the two is played as short as the sounder allows.  The local key and
+ * status signals are never delayed.
+ */
+type outputRouter struct {
+    clock       clock
+
+    mutex       sync.Mutex
+    outputs     []OutputConfig
+    pins        []ledBackend
+    delay       time.Duration   // the longest compensation, added to all remote keying
+    channel     string          // channel the client is on
+    generation  int             // changes with the outputs so old timers are ignored
+    local       bool            // latest request from the local key
+    status      bool            // latest request from status signals
+    target      []bool          // remote keying each output has been told to follow
+    remote      []bool          // remote keying each output is following now
+    due         []time.Time     // when each output's latest remote edge is driven
+    sequence    []int           // count of remote edges given to each output
+    applied     []int           // the last of them driven
+}
+
+
+
+/**
+ * Create an output router with every output off.
+ *
+ * @param   outputs the output pins and their sources
+ * @param   c       clock remote keying is timed with
+ * @return  r       the output router
+ */
+func newOutputRouter(outputs []OutputConfig, c clock) *outputRouter {
+    r := &outputRouter{clock: c}
+    r.setOutputs(outputs)
+    return r
+}
+
+
+
+/**
+ * Change the output pins.  Pins no longer used are turned off first.
+ */
+func (r *outputRouter) setOutputs(outputs []OutputConfig) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    for _, pin := range r.pins {
+        pin.set(false)
+    }
+    r.outputs = outputs
+    r.delay = compensationDelay(outputs)
+    r.generation++
+    r.pins = nil
+    r.target = make([]bool, len(outputs))
+    r.remote = make([]bool, len(outputs))
+    r.due = make([]time.Time, len(outputs))
+    r.sequence = make([]int, len(outputs))
+    r.applied = make([]int, len(outputs))
+    for _, output := range outputs {
+        r.pins = append(r.pins, newToneOutput(output.Pin, output.ActiveLow, output.ToneHz, output.Duty))
+        fmt.Println("output: BCM", output.Pin, "from", output.Source, output.Channel,
+                    "pull in", output.PullInMs, "ms release", output.ReleaseMs, "ms tone", output.ToneHz, "Hz")
+    }
+    if r.delay > 0 {
+        fmt.Println("remote keying delayed", r.delay, "for sounder compensation")
+    }
+}
+
+
+
+/**
+ * Record which channel the client is on, for outputs tied to one.
+ */
+func (r *outputRouter) setChannel(channel string) {
+    r.mutex.Lock()
+    r.channel = channel
+    r.mutex.Unlock()
+}
+
+
+
+/**
+ * Set every output from its source after the arbiter has taken a
+ * request.  Remote keying is scheduled with each output's compensation.
+ *
+ * @param   a       the sounder arbiter, for what each source wants
+ * @param   at      when the request was made
+ */
+func (r *outputRouter) update(a *sounderArbiter, at time.Time) {
+    hearing := a.hearingRemote()
+    remote := a.wanted(SRC_REMOTE)
+
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.local = a.wanted(SRC_LOCAL)
+    r.status = a.wanted(SRC_STATUS)
+
+    for i, output := range r.outputs {
+        var follow bool
+        switch output.Source {
+        case OUT_SOUNDER:
+            follow = hearing
+        case OUT_REMOTE:
+            follow = remote && (output.Channel == "" || output.Channel == r.channel)
+        default:
+            continue
+        }
+        if follow != r.target[i] {
+            r.target[i] = follow
+            r.schedule(i, follow, at)
+        }
+    }
+    r.drive()
+}
+
+
+
+/**
+ * Schedule a remote edge for one output.  The caller must hold the
+ * mutex.
+ */
+func (r *outputRouter) schedule(i int, on bool, at time.Time) {
+    compensation := r.outputs[i].ReleaseMs
+    if on {
+        compensation = r.outputs[i].PullInMs
+    }
+    due := at.Add(r.delay - time.Duration(compensation * float64(time.Millisecond)))
+    if due.Before(r.due[i]) {
+        due = r.due[i]                          // never drive edges out of order
+    }
+    r.due[i] = due
+    r.sequence[i]++
+
+    wait := due.Sub(r.clock.now())
+    if wait <= 0 {
+        r.remote[i] = on
+        r.applied[i] = r.sequence[i]
+        return
+    }
+    generation, sequence := r.generation, r.sequence[i]
+    r.clock.afterFunc(wait, func() {
+        r.mutex.Lock()
+        defer r.mutex.Unlock()
+        if generation != r.generation || sequence <= r.applied[i] {
+            return                              // outputs changed, or a later edge got there first
+        }
+        r.remote[i] = on
+        r.applied[i] = sequence
+        r.drive()
+    })
+}
+
+
+
+/**
+ * Write every pin.  The caller must hold the mutex.
+ */
+func (r *outputRouter) drive() {
+    pinOn := make(map[int]bool)
+    for i, output := range r.outputs {
+        var on bool
+        switch output.Source {
+        case OUT_SOUNDER:
+            on = r.local || r.status || r.remote[i]
+        case OUT_LOCAL:
+            on = r.local
+        case OUT_REMOTE:
+            on = r.remote[i]
+        case OUT_STATUS:
+            on = r.status
+        }
+        pinOn[output.Pin] = pinOn[output.Pin] || on     // outputs sharing a pin are combined
+    }
+    for i, output := range r.outputs {
+        r.pins[i].set(pinOn[output.Pin])
+    }
+}
+
+
+
+/**
+ * Turn every output off.
+ */
+func (r *outputRouter) release() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.generation++
+    for _, pin := range r.pins {
+        pin.set(false)
+    }
+}
+
+/* end of file */
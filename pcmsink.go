@@ -0,0 +1,188 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "strconv"
+)
+
+
+
+// where software audio goes
+const(
+    SINK_NONE       = "none"        // no audio
+    SINK_STDOUT     = "stdout"      // raw 16 bit little endian PCM
+    SINK_APLAY      = "aplay"       // piped to ALSA's aplay
+    SINK_WAV        = "wav"         // written to a WAV file
+    )
+
+
+
+/**
+ * Somewhere to send 16 bit PCM samples, interleaved if there are two
+ * channels.
+ */
+type pcmSink interface {
+    write(samples []int16) error
+    close() error
+}
+
+
+
+/**
+ * Open the sink named in the audio configuration.
+ *
+ * The stdout sink takes over standard output for the samples, so from
+ * then on the log is written to standard error.
+ *
+ * @param   config  audio settings
+ * @return  pcmSink the sink
+ * @return  error   set if the sink could not be opened
+ */
+func newPCMSink(config AudioConfig) (pcmSink, error) {
+    switch config.Sink {
+    case SINK_NONE, "":
+        return discardSink{}, nil
+    case SINK_STDOUT:
+        out := os.Stdout
+        os.Stdout = os.Stderr                   // keep the log out of the audio
+        return &rawSink{out: out}, nil
+    case SINK_APLAY:
+        return newAplaySink(config)
+    case SINK_WAV:
+        return newWavSink(config.Path, config.SampleRate, audioChannels(config))
+    }
+    return nil, fmt.Errorf("unknown audio sink %q", config.Sink)
+}
+
+
+
+// sink that throws the samples away
+type discardSink struct{}
+
+func (discardSink) write(samples []int16) error {
+    return nil
+}
+
+func (discardSink) close() error {
+    return nil
+}
+
+
+
+// sink that writes little endian samples with no header
+type rawSink struct {
+    out     io.WriteCloser
+}
+
+func (s *rawSink) write(samples []int16) error {
+    return binary.Write(s.out, binary.LittleEndian, samples)
+}
+
+func (s *rawSink) close() error {
+    return s.out.Close()
+}
+
+
+
+// sink that plays the samples through aplay with a short buffer
+type aplaySink struct {
+    rawSink
+    command *exec.Cmd
+}
+
+
+
+func newAplaySink(config AudioConfig) (*aplaySink, error) {
+    args := []string{"-q", "-t", "raw", "-f", "S16_LE", "-c", strconv.Itoa(audioChannels(config)),
+                     "-r", strconv.Itoa(config.SampleRate), "--buffer-time=50000"}
+    if config.Device != "" {
+        args = append(args, "-D", config.Device)
+    }
+    command := exec.Command("aplay", args...)
+    command.Stderr = os.Stderr
+    in, err := command.StdinPipe()
+    if err != nil {
+        return nil, err
+    }
+    if err := command.Start(); err != nil {
+        return nil, fmt.Errorf("starting aplay: %v", err)
+    }
+    return &aplaySink{rawSink: rawSink{out: in}, command: command}, nil
+}
+
+
+
+func (s *aplaySink) close() error {
+    s.rawSink.close()
+    return s.command.Wait()
+}
+
+
+
+/**
+ * Sink that writes a WAV file.  The sizes in the header are filled in
+ * when the sink is closed.
+ */
+type wavSink struct {
+    file    *os.File
+    bytes   uint32          // sample data written so far
+}
+
+
+
+func newWavSink(path string, sampleRate int, channels int) (*wavSink, error) {
+    file, err := os.Create(path)
+    if err != nil {
+        return nil, err
+    }
+    s := &wavSink{file: file}
+    if err := s.header(uint32(sampleRate), uint16(channels)); err != nil {
+        file.Close()
+        return nil, err
+    }
+    return s, nil
+}
+
+
+
+// write the 44 byte RIFF header for 16 bit PCM
+func (s *wavSink) header(sampleRate uint32, channels uint16) error {
+    frame := 2 * channels                       // bytes per sample on every channel
+    fields := []interface{}{
+        []byte("RIFF"), uint32(36 + s.bytes), []byte("WAVE"),
+        []byte("fmt "), uint32(16), uint16(1), channels,
+        sampleRate, sampleRate * uint32(frame), frame, uint16(16),
+        []byte("data"), s.bytes,
+    }
+    for _, field := range fields {
+        if err := binary.Write(s.file, binary.LittleEndian, field); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (s *wavSink) write(samples []int16) error {
+    s.bytes += uint32(2 * len(samples))
+    return binary.Write(s.file, binary.LittleEndian, samples)
+}
+
+func (s *wavSink) close() error {
+    defer s.file.Close()
+    if _, err := s.file.Seek(4, io.SeekStart); err != nil {
+        return err
+    }
+    if err := binary.Write(s.file, binary.LittleEndian, uint32(36 + s.bytes)); err != nil {
+        return err
+    }
+    if _, err := s.file.Seek(40, io.SeekStart); err != nil {
+        return err
+    }
+    return binary.Write(s.file, binary.LittleEndian, s.bytes)
+}
+
+/* end of file */
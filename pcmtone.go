@@ -0,0 +1,376 @@
+package main
+
+import (
+    "fmt"
+    "hash/fnv"
+    "math"
+    "sync"
+    "time"
+)
+
+
+
+// length of the blocks of samples handed to the sink
+const audioBlock = 10 * time.Millisecond
+
+
+
+/**
+ * Software side tone, read from the "audio" section of config.json.
+ */
+type AudioConfig struct {
+    Sink        string  `json:"sink"`       // "none", "stdout", "aplay" or "wav"
+    Path        string  `json:"path"`       // file written by the wav sink
+    Device      string  `json:"device"`     // ALSA device for the aplay sink, "" for the default
+    PitchHz     float64 `json:"pitchHz"`
+    Volume      float64 `json:"volume"`     // 0 to 1
+    RiseMs      float64 `json:"riseMs"`     // raised cosine rise and fall time
+    SampleRate  int     `json:"sampleRate"`
+    Channels    int     `json:"channels"`   // 1 for mono, 2 for stereo with remote stations panned
+    SpreadHz    float64 `json:"spreadHz"`   // remote stations are pitched up to this far either side of PitchHz
+    Stations    map[string]StationVoice `json:"stations"` // fixed voices for particular sender ids
+    Voice       string  `json:"voice"`      // "tone" or "sounder"
+    ClickPath   string  `json:"clickPath"`  // WAV file for the sounder's key down click, "" for the built in one
+    ClackPath   string  `json:"clackPath"`  // WAV file for the sounder's key up clack, "" for the built in one
+    Band        map[string]BandConditions `json:"band"` // simulated band conditions by channel name
+}
+
+
+
+/**
+ * The pitch and stereo position one station is heard at.
+ */
+type StationVoice struct {
+    PitchHz     float64 `json:"pitchHz"`
+    Pan         float64 `json:"pan"`        // -1 hard left, 0 centre, 1 hard right
+}
+
+
+
+func defaultAudioConfig() AudioConfig {
+    return AudioConfig{Sink: "none", PitchHz: 700, Volume: 0.5, RiseMs: 5, SampleRate: 22050,
+                       Channels: 1, SpreadHz: 200, Voice: VOICE_TONE}
+}
+
+
+
+// the number of channels the generator makes for a configuration
+func audioChannels(config AudioConfig) int {
+    if 2 == config.Channels {
+        return 2
+    }
+    return 1
+}
+
+
+
+/**
+ * The voice a remote station is heard with.  A station listed in the
+ * config keeps the voice given there.  Any other is given one of nine
+ * pitches across SpreadHz either side of PitchHz, and one of five
+ * stereo positions, picked from a hash of its sender id so it sounds the
+ * same every time it is heard.
+ *
+ * @param   config  audio settings
+ * @param   id      the station's sender id
+ * @return  StationVoice    its pitch and pan
+ */
+func stationVoice(config AudioConfig, id string) StationVoice {
+    if v, ok := config.Stations[id]; ok {
+        if 0 == v.PitchHz {
+            v.PitchHz = config.PitchHz
+        }
+        return v
+    }
+    h := fnv.New32a()
+    h.Write([]byte(id))
+    sum := h.Sum32()
+    return StationVoice{
+        PitchHz:    config.PitchHz + config.SpreadHz * float64(int(sum % 9) - 4) / 4,
+        Pan:        float64(int((sum >> 16) % 5) - 2) * 0.4,
+    }
+}
+
+
+
+/**
+ * Generates keyed sine waves as 16 bit PCM.
+ *
+ * The local key has a voice at PitchHz in the centre, and each remote
+ * station heard gets a voice of its own from stationVoice(), so
+ * overlapping senders can be told apart.  The voices are mixed, and with
+ * two channels each is panned to its place.  Each key down and key up
+ * is shaped with a raised cosine over RiseMs so the tone starts and
+ * stops without a click.
+ *
+ * With the sounder voice there are no sine waves: each key down plays a
+ * click and each key up a clack, like a sounder's armature striking its
+ * stops.  A station's sample is played faster or slower by the ratio of
+ * its pitch to PitchHz, so stations still sound different.
+ *
+ * Band conditions set for the channel add hiss and interference to
+ * everything and fade the remote stations.  run() hands a block of samples to the sink
+ * every audioBlock, timed by the clock.  render() produces the next
+ * samples without a sink, so the output can be checked sample by sample.
+ */
+type toneGenerator struct {
+    config      AudioConfig
+    sink        pcmSink
+    clock       clock
+    done        chan struct{}
+    finished    chan struct{}
+
+    mutex       sync.Mutex
+    voices      map[string]*voice   // by sender id, "" for the local key
+    rampLength  int
+    click       []float64           // sounder voice key down sample, nil for the tone voice
+    clack       []float64           // sounder voice key up sample
+    band        *bandEffects        // conditions on the channel, nil for a clean one
+}
+
+
+
+// one keyed sine wave, or sounder
+type voice struct {
+    keyIsDown   bool
+    step        float64         // phase change per sample, in radians
+    left, right float64         // gain into each channel
+    phase       float64         // of the sine wave, in radians
+    ramp        int             // samples into the rise, 0 is silent
+    rate        float64         // sounder samples played per output sample
+    strike      []float64       // sounder sample playing, nil when quiet
+    position    float64         // how far through it
+}
+
+
+
+/**
+ * Create a tone generator.
+ *
+ * @param   config  pitch, volume, envelope, sample rate and channels
+ * @param   sink    where run() sends the samples, may be nil if only
+ *                  render() is used
+ * @param   c       clock that paces run()
+ * @return  g       the tone generator, key up
+ */
+func newToneGenerator(config AudioConfig, sink pcmSink, c clock) *toneGenerator {
+    config.Channels = audioChannels(config)
+    g := &toneGenerator{
+        config:     config,
+        sink:       sink,
+        clock:      c,
+        done:       make(chan struct{}),
+        finished:   make(chan struct{}),
+        voices:     make(map[string]*voice),
+        rampLength: int(config.RiseMs * float64(config.SampleRate) / 1000),
+    }
+    if g.rampLength < 1 {
+        g.rampLength = 1
+    }
+    if VOICE_SOUNDER == config.Voice {
+        g.click, g.clack = sounderSamples(config)
+    }
+    g.voices[""] = g.newVoice(StationVoice{PitchHz: config.PitchHz})
+    return g
+}
+
+
+
+// a silent voice at a pitch, panned with equal power
+func (g *toneGenerator) newVoice(sv StationVoice) *voice {
+    v := &voice{step: 2 * math.Pi * sv.PitchHz / float64(g.config.SampleRate), left: 1, right: 1,
+                 rate: sv.PitchHz / g.config.PitchHz}
+    if 2 == g.config.Channels {
+        angle := (math.Max(-1, math.Min(1, sv.Pan)) + 1) * math.Pi / 4
+        v.left, v.right = math.Cos(angle), math.Sin(angle)
+    }
+    return v
+}
+
+
+
+/**
+ * Apply the band conditions configured for a channel, or none if it has
+ * none.
+ *
+ * @param   channel the channel name
+ */
+func (g *toneGenerator) setChannel(channel string) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    g.band = nil
+    if conditions, ok := g.config.Band[channel]; ok {
+        fmt.Println("Simulating band conditions on", channel + ":", fmt.Sprintf("%+v", conditions))
+        g.band = newBandEffects(conditions, g.config, g.rampLength)
+    }
+}
+
+
+
+/**
+ * A random timing error to add to a remote key event, from the band
+ * conditions.
+ *
+ * @return  time.Duration   the error, 0 on a clean channel
+ */
+func (g *toneGenerator) jitter() time.Duration {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    if nil == g.band {
+        return 0
+    }
+    return g.band.jitter()
+}
+
+
+
+/**
+ * Key the local tone on or off.  The change starts with the next sample.
+ *
+ * @param   down    true for key down
+ */
+func (g *toneGenerator) key(down bool) {
+    g.keyStation("", down)
+}
+
+
+
+/**
+ * Key a remote station's tone on or off, giving the station its voice
+ * the first time it is heard.
+ *
+ * @param   id      the station's sender id
+ * @param   down    true for key down
+ */
+func (g *toneGenerator) keyStation(id string, down bool) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+    v, ok := g.voices[id]
+    if !ok {
+        sv := stationVoice(g.config, id)
+        fmt.Println("Station", id, "is heard at", sv.PitchHz, "Hz, pan", sv.Pan)
+        v = g.newVoice(sv)
+        g.voices[id] = v
+    }
+    if g.click != nil && down != v.keyIsDown {
+        v.strike, v.position = g.clack, 0      // the armature leaves one stop for the other
+        if down {
+            v.strike = g.click
+        }
+    }
+    v.keyIsDown = down
+}
+
+
+
+/**
+ * Fill a buffer with the next samples, interleaved left then right when
+ * there are two channels.
+ *
+ * @param   samples the buffer to fill
+ */
+func (g *toneGenerator) render(samples []int16) {
+    g.mutex.Lock()
+    defer g.mutex.Unlock()
+
+    channels := g.config.Channels
+    for i := 0; i + channels <= len(samples); i += channels {
+        var left, right float64
+        fade, added := 1.0, 0.0
+        if g.band != nil {
+            fade, added = g.band.next()
+        }
+        for id, v := range g.voices {
+            gain := g.config.Volume
+            if id != "" {
+                gain *= fade                    // only what comes over the band fades
+            }
+            if g.click != nil {
+                level := gain * v.sounder()
+                left += level * v.left
+                right += level * v.right
+                continue
+            }
+            if v.keyIsDown && v.ramp < g.rampLength {
+                v.ramp++
+            } else if !v.keyIsDown && v.ramp > 0 {
+                v.ramp--
+            }
+            if 0 == v.ramp {
+                v.phase = 0                     // start every element at the same point
+                continue
+            }
+            envelope := 0.5 - 0.5 * math.Cos(math.Pi * float64(v.ramp) / float64(g.rampLength))
+            level := gain * envelope * math.Sin(v.phase)
+            left += level * v.left
+            right += level * v.right
+            v.phase = math.Mod(v.phase + v.step, 2 * math.Pi)
+        }
+        samples[i] = pcmSample(left + g.config.Volume * added)
+        if 2 == channels {
+            samples[i + 1] = pcmSample(right + g.config.Volume * added)
+        }
+    }
+}
+
+
+
+// the next level of the sounder sample playing, 0 once it has finished
+func (v *voice) sounder() float64 {
+    i := int(v.position)
+    if nil == v.strike || i + 1 >= len(v.strike) {
+        v.strike = nil
+        return 0
+    }
+    fraction := v.position - float64(i)
+    v.position += v.rate
+    return v.strike[i] * (1 - fraction) + v.strike[i + 1] * fraction
+}
+
+
+
+// a level from -1 to 1 as a sample, clipped where voices add up past full scale
+func pcmSample(level float64) int16 {
+    return int16(math.MaxInt16 * math.Max(-1, math.Min(1, level)))
+}
+
+
+
+/**
+ * Goroutine that sends the tone to the sink in real time until stop()
+ * is called.
+ */
+func (g *toneGenerator) run() {
+    defer close(g.finished)
+    samples := make([]int16, g.config.Channels * g.config.SampleRate * int(audioBlock / time.Millisecond) / 1000)
+    next := g.clock.now()
+    for {
+        select {
+        case <-g.done:
+            return
+        default:
+        }
+        g.render(samples)
+        if err := g.sink.write(samples); err != nil {
+            fmt.Println("Audio output failed:", err)
+            return
+        }
+        next = next.Add(audioBlock)
+        g.clock.sleep(next.Sub(g.clock.now()))
+    }
+}
+
+
+
+/**
+ * Stop run() and close the sink.
+ */
+func (g *toneGenerator) stop() {
+    close(g.done)
+    <-g.finished
+    if err := g.sink.close(); err != nil {
+        fmt.Println("Closing the audio output failed:", err)
+    }
+}
+
+/* end of file */
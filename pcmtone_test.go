@@ -0,0 +1,138 @@
+package main
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+
+
+/**
+ * A mono tone generator at a quarter of the sample rate, so the sine
+ * wave's samples run 0, 1, 0, -1 and every odd sample shows the
+ * envelope.  RiseMs gives a 40 sample rise.
+ */
+func newTestTone(channels int) *toneGenerator {
+    config := defaultAudioConfig()
+    config.SampleRate = 8000
+    config.PitchHz = 2000
+    config.RiseMs = 5
+    config.Channels = channels
+    return newToneGenerator(config, nil, newFakeClock(time.Unix(1000, 0)))
+}
+
+
+
+// the size of the odd, peak, samples of a mono buffer
+func peaks(samples []int16) []int {
+    var levels []int
+    for i := 1; i < len(samples); i += 2 {
+        levels = append(levels, int(math.Abs(float64(samples[i]))))
+    }
+    return levels
+}
+
+
+
+func TestToneIsSilentWhileKeyUp(t *testing.T) {
+    g := newTestTone(1)
+    samples := make([]int16, 200)
+    g.render(samples)
+    for i, s := range samples {
+        if s != 0 {
+            t.Fatalf("sample %d is %d with the key up", i, s)
+        }
+    }
+}
+
+
+
+func TestToneEnvelopeRisesAndFalls(t *testing.T) {
+    g := newTestTone(1)
+    full := int(pcmSample(g.config.Volume))
+
+    g.key(true)
+    rise := make([]int16, 40)
+    g.render(rise)
+    levels := peaks(rise)
+    if levels[0] > full / 50 {
+        t.Errorf("tone starts at %d, want it to start near silence", levels[0])
+    }
+    for i := 1; i < len(levels); i++ {
+        if levels[i] < levels[i - 1] {
+            t.Errorf("rise falls from %d to %d at peak %d", levels[i - 1], levels[i], i)
+        }
+    }
+
+    steady := make([]int16, 40)
+    g.render(steady)
+    for i, level := range peaks(steady) {
+        if level < full - 1 {
+            t.Errorf("steady tone peak %d is %d, want %d", i, level, full)
+        }
+    }
+
+    g.key(false)
+    fall := make([]int16, 40)
+    g.render(fall)
+    levels = peaks(fall)
+    for i := 1; i < len(levels); i++ {
+        if levels[i] > levels[i - 1] {
+            t.Errorf("fall rises from %d to %d at peak %d", levels[i - 1], levels[i], i)
+        }
+    }
+    if levels[len(levels) - 1] > full / 50 {
+        t.Errorf("tone ends at %d, want it to end near silence", levels[len(levels) - 1])
+    }
+
+    after := make([]int16, 40)
+    g.render(after)
+    for i, s := range after {
+        if s != 0 {
+            t.Fatalf("sample %d after the fall is %d", i, s)
+        }
+    }
+}
+
+
+
+func TestTonePansStationsInStereo(t *testing.T) {
+    g := newTestTone(2)
+    g.config.Stations = map[string]StationVoice{"0001": {Pan: -1}, "0002": {Pan: 1}}
+
+    g.keyStation("0001", true)
+    samples := make([]int16, 400)
+    g.render(samples)
+    var left, right int
+    for i := 0; i < len(samples); i += 2 {
+        left += int(math.Abs(float64(samples[i])))
+        right += int(math.Abs(float64(samples[i + 1])))
+    }
+    if 0 == left || right > left / 1000 {
+        t.Errorf("station panned left sounds %d left and %d right", left, right)
+    }
+
+    g.keyStation("0001", false)
+    g.keyStation("0002", true)
+    g.render(samples)                           // the first station fades out here
+    g.render(samples)
+    left, right = 0, 0
+    for i := 0; i < len(samples); i += 2 {
+        left += int(math.Abs(float64(samples[i])))
+        right += int(math.Abs(float64(samples[i + 1])))
+    }
+    if 0 == right || left > right / 1000 {
+        t.Errorf("station panned right sounds %d left and %d right", left, right)
+    }
+}
+
+
+
+func TestPCMSampleClipsAtFullScale(t *testing.T) {
+    if pcmSample(2) != math.MaxInt16 || pcmSample(-2) != -math.MaxInt16 || pcmSample(0) != 0 {
+        t.Errorf("samples for 2, -2 and 0 are %d, %d and %d", pcmSample(2), pcmSample(-2), pcmSample(0))
+    }
+}
+
+/* end of file */
@@ -0,0 +1,101 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+
+    "github.com/stianeikeland/go-rpio"
+)
+
+
+
+// steps in one cycle of the PWM tone; sets how finely the duty cycle can be set
+const pwmCycle = 64
+
+
+
+/**
+ * A passive piezo sounded with a square wave from the Pi's hardware
+ * PWM.  The tone needs no CPU time once started, so it is clean where
+ * toggling a pin from a goroutine was not.
+ *
+ * Only BCM 12, 13, 18 and 19 are wired to the PWM hardware.  12 and 18
+ * share one PWM channel and 13 and 19 the other, and all four share one
+ * clock, so two tone outputs must use the same pitch.
+ */
+type pwmTone struct {
+    pin     rpio.Pin
+    duty    uint32
+}
+
+
+
+/**
+ * Start a PWM tone output, silent.  rpio must already be open with root
+ * permission; without it the PWM registers cannot be written.
+ *
+ * @param   bcm     BCM pin number
+ * @param   hz      tone frequency
+ * @param   duty    fraction of each cycle the output is high, 0 for 0.5
+ * @return  p       the tone output
+ * @return  error   set if the pin cannot make a PWM tone
+ */
+func newPWMTone(bcm int, hz int, duty float64) (*pwmTone, error) {
+    switch bcm {
+    case 12, 13, 18, 19:
+    default:
+        return nil, fmt.Errorf("BCM %d has no hardware PWM; use 12, 13, 18 or 19", bcm)
+    }
+    if os.Geteuid() != 0 {
+        return nil, errors.New("hardware PWM needs root permission")
+    }
+    if duty <= 0 || duty >= 1 {
+        duty = 0.5
+    }
+
+    p := &pwmTone{pin: rpio.Pin(bcm), duty: uint32(duty * pwmCycle + 0.5)}
+    p.pin.Pwm()
+    p.pin.DutyCycle(0, pwmCycle)
+    p.pin.Freq(hz * pwmCycle)
+    return p, nil
+}
+
+
+
+func (p *pwmTone) set(on bool) error {
+    if on {
+        p.pin.DutyCycle(p.duty, pwmCycle)
+    } else {
+        p.pin.DutyCycle(0, pwmCycle)
+    }
+    return nil
+}
+
+
+
+/**
+ * Create a sounder output: a PWM tone for a passive piezo if a pitch is
+ * given and the pin can make one, otherwise a plain on/off output for an
+ * active buzzer or a sounder.
+ *
+ * @param   bcm         BCM pin number
+ * @param   activeLow   the on/off output is pulled low to sound
+ * @param   hz          PWM tone frequency, 0 for on/off
+ * @param   duty        PWM duty cycle, 0 for 0.5
+ * @return  ledBackend  the output, off
+ */
+func newToneOutput(bcm int, activeLow bool, hz int, duty float64) ledBackend {
+    if hz > 0 {
+        pwm, err := newPWMTone(bcm, hz, duty)
+        if err == nil {
+            return pwm
+        }
+        fmt.Println("PWM tone on BCM", bcm, "not available, using on/off:", err)
+    }
+    out := newGpioLED(bcm, activeLow)
+    out.set(false)
+    return out
+}
+
+/* end of file */
@@ -0,0 +1,398 @@
+package main
+
+import (
+    "fmt"
+    "math/rand"
+    "sync"
+    "time"
+)
+
+
+
+/**
+ * Socket client connection states.
+ *
+ *  SC_NOT_STARTED  -> SC_CONNECTED, SC_RECONNECTING
+ *  SC_CONNECTED    -> SC_DISCONNECTED
+ *  SC_DISCONNECTED -> SC_RECONNECTING
+ *  SC_RECONNECTING -> SC_CONNECTED, SC_FAILED
+ *  SC_FAILED       -> SC_RECONNECTING
+ */
+const(
+    SC_NOT_STARTED  = "not started"
+    SC_DISCONNECTED = "disconnected"
+    SC_CONNECTED    = "connected"
+    SC_RECONNECTING = "reconnecting"
+    SC_FAILED       = "failed"          // gave up redialling
+    )
+
+var scTransitions = map[string][]string{
+    SC_NOT_STARTED:     {SC_CONNECTED, SC_RECONNECTING},
+    SC_CONNECTED:       {SC_DISCONNECTED},
+    SC_DISCONNECTED:    {SC_RECONNECTING},
+    SC_RECONNECTING:    {SC_CONNECTED, SC_FAILED},
+    SC_FAILED:          {SC_RECONNECTING},
+}
+
+
+
+/**
+ * Events reported by the reconnect manager so the user can be told
+ * what the connection is doing.
+ */
+const(
+    EV_CONNECTED    = "connected"       // first connection after start up
+    EV_RECONNECTING = "reconnecting"    // an established connection was lost
+    EV_OUTAGE       = "longOutage"      // still disconnected after AlertAfter attempts
+    EV_RECONNECTED  = "reconnected"     // reconnected before the outage alert
+    EV_RESTORED     = "restored"        // reconnected after a long outage
+    EV_UNREACHABLE  = "unreachable"     // gave up after GiveUpAfter attempts
+    )
+
+
+
+/**
+ * Redial timing, read from the "reconnect" section of config.json.
+ *
+ * The first SilentAttempts redials happen immediately.  After that the
+ * delay starts at InitialDelayMs and doubles on each failure up to
+ * MaxDelayMs.  Each delay is randomly varied by +/- Jitter (a fraction)
+ * so a room full of telegraphs does not redial in step.
+ */
+type ReconnectConfig struct {
+    InitialDelayMs  int64       `json:"initialDelayMs"`
+    MaxDelayMs      int64       `json:"maxDelayMs"`
+    Jitter          float64     `json:"jitter"`
+    SilentAttempts  int         `json:"silentAttempts"`   // immediate redials before backing off
+    AlertAfter      int         `json:"alertAfter"`       // failed attempts before EV_OUTAGE
+    GiveUpAfter     int         `json:"giveUpAfter"`      // failed attempts before SC_FAILED, 0 = never
+}
+
+
+
+/**
+ * Default redial timing.
+ *
+ * @return  rc      reconnect configuration with default values
+ */
+func defaultReconnectConfig() ReconnectConfig {
+    return ReconnectConfig{
+        InitialDelayMs: 1000,
+        MaxDelayMs:     30000,
+        Jitter:         0.2,
+        SilentAttempts: 2,
+        AlertAfter:     3,
+        GiveUpAfter:    0,
+    }
+}
+
+
+
+/**
+ * Replace out of range values with their defaults.
+ *
+ * @return  rc      the corrected reconnect configuration
+ */
+func (rc ReconnectConfig) normalized() ReconnectConfig {
+    def := defaultReconnectConfig()
+    if rc.InitialDelayMs <= 0 {
+        rc.InitialDelayMs = def.InitialDelayMs
+    }
+    if rc.MaxDelayMs < rc.InitialDelayMs {
+        rc.MaxDelayMs = rc.InitialDelayMs
+    }
+    if rc.Jitter < 0 || rc.Jitter > 1 {
+        rc.Jitter = def.Jitter
+    }
+    if rc.SilentAttempts < 0 {
+        rc.SilentAttempts = 0
+    }
+    if rc.AlertAfter <= 0 {
+        rc.AlertAfter = def.AlertAfter
+    }
+    if rc.GiveUpAfter < 0 {
+        rc.GiveUpAfter = 0
+    }
+    return rc
+}
+
+
+
+/**
+ * Tracks the connection state and decides when to redial.
+ *
+ * The client asks due() whether it is time to dial, calls dialing(),
+ * then reports the outcome with connected() or dialFailed().  A lost
+ * connection is reported with lost().  Every connection gets a new
+ * generation number so a receive goroutine left over from an old
+ * connection cannot tear down a newer one.
+ */
+type reconnector struct {
+    config      ReconnectConfig
+    clock       clock
+    random      *rand.Rand
+    onEvent     func(event string)
+
+    mutex       sync.Mutex
+    status      string
+    attempts    int             // failed attempts since the last connection
+    nextAttempt time.Time
+    alerted     bool            // EV_OUTAGE has been reported for this outage
+    everUp      bool            // a connection has been made at least once
+    generation  int
+}
+
+
+
+/**
+ * Create a reconnect manager.
+ *
+ * @param   config  redial timing
+ * @param   c       clock used to time redials
+ * @param   onEvent called with EV_* events, may be nil
+ * @return  r       the reconnect manager
+ */
+func newReconnector(config ReconnectConfig, c clock, onEvent func(event string)) *reconnector {
+    return &reconnector{
+        config:     config.normalized(),
+        clock:      c,
+        random:     rand.New(rand.NewSource(c.now().UnixNano())),
+        onEvent:    onEvent,
+        status:     SC_NOT_STARTED,
+    }
+}
+
+
+
+/**
+ * Change the redial timing.  Applies from the next failed attempt.
+ *
+ * @param   config  new redial timing
+ */
+func (r *reconnector) setConfig(config ReconnectConfig) {
+    r.mutex.Lock()
+    r.config = config.normalized()
+    r.mutex.Unlock()
+}
+
+
+
+/**
+ * Current connection state, one of the SC_* values.
+ */
+func (r *reconnector) state() string {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.status
+}
+
+
+
+/**
+ * Move to a new state.  The caller must hold the mutex.
+ *
+ * @return  bool    false if the state machine does not allow the move
+ */
+func (r *reconnector) setStatus(to string) bool {
+    for _, allowed := range scTransitions[r.status] {
+        if allowed == to {
+            fmt.Println("connection status:", r.status, "->", to)
+            r.status = to
+            return true
+        }
+    }
+    fmt.Println("connection status: ignoring", r.status, "->", to)
+    return false
+}
+
+
+
+/**
+ * Report whether a dial attempt should be made now.
+ */
+func (r *reconnector) due() bool {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    switch r.status {
+    case SC_NOT_STARTED, SC_DISCONNECTED:
+        return true
+    case SC_RECONNECTING:
+        return !r.clock.now().Before(r.nextAttempt)
+    }
+    return false
+}
+
+
+
+/**
+ * Record that a dial attempt is starting.
+ */
+func (r *reconnector) dialing() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if SC_DISCONNECTED == r.status {
+        r.setStatus(SC_RECONNECTING)
+    }
+}
+
+
+
+/**
+ * Record a successful dial and start the receive goroutine for it.
+ *
+ * The receive function is run under supervision: when it returns, for
+ * any reason, the connection it belongs to is reported lost.
+ *
+ * @param   receive blocking receive loop for the new connection
+ */
+func (r *reconnector) connected(receive func() error) {
+    r.mutex.Lock()
+    if !r.setStatus(SC_CONNECTED) {
+        r.mutex.Unlock()
+        return
+    }
+    event := EV_RECONNECTED
+    if !r.everUp {
+        event = EV_CONNECTED
+    } else if r.alerted {
+        event = EV_RESTORED
+    }
+    r.everUp = true
+    r.attempts = 0
+    r.alerted = false
+    r.generation++
+    generation := r.generation
+    r.mutex.Unlock()
+
+    if receive != nil {
+        go r.supervise(generation, receive)
+    }
+    r.report(event)
+}
+
+
+
+func (r *reconnector) supervise(generation int, receive func() error) {
+    defer func() {
+        if p := recover(); p != nil {
+            fmt.Println("receiver for connection", generation, "panicked:", p)
+        }
+        r.lost(generation)
+    }()
+    fmt.Println("receiver started for connection", generation)
+    err := receive()
+    fmt.Println("receiver for connection", generation, "stopped:", err)
+}
+
+
+
+/**
+ * Record a failed dial and schedule the next one.
+ */
+func (r *reconnector) dialFailed() {
+    r.mutex.Lock()
+    if SC_RECONNECTING != r.status && !r.setStatus(SC_RECONNECTING) {
+        r.mutex.Unlock()
+        return
+    }
+    r.attempts++
+    delay := r.backoff(r.attempts)
+    r.nextAttempt = r.clock.now().Add(delay)
+    fmt.Println("redial attempt", r.attempts, "failed, next attempt in", delay)
+
+    event := ""
+    if r.config.GiveUpAfter > 0 && r.attempts >= r.config.GiveUpAfter {
+        r.setStatus(SC_FAILED)
+        event = EV_UNREACHABLE
+    } else if !r.alerted && r.attempts >= r.config.AlertAfter {
+        r.alerted = true
+        event = EV_OUTAGE
+    }
+    r.mutex.Unlock()
+
+    r.report(event)
+}
+
+
+
+/**
+ * Delay before the next attempt after 'attempts' failures.  The caller
+ * must hold the mutex because of the shared random source.
+ */
+func (r *reconnector) backoff(attempts int) time.Duration {
+    if attempts <= r.config.SilentAttempts {
+        return 0
+    }
+    delay := r.config.InitialDelayMs
+    for i := r.config.SilentAttempts + 1; i < attempts && delay < r.config.MaxDelayMs; i++ {
+        delay *= 2
+    }
+    if delay > r.config.MaxDelayMs {
+        delay = r.config.MaxDelayMs
+    }
+    jittered := float64(delay) * (1 + r.config.Jitter*(2*r.random.Float64()-1))
+    return time.Duration(jittered) * time.Millisecond
+}
+
+
+
+/**
+ * Report that a connection has gone away.
+ *
+ * @param   generation  the connection that was lost; reports about
+ *                      older connections are ignored
+ */
+func (r *reconnector) lost(generation int) {
+    r.mutex.Lock()
+    if generation != r.generation || SC_CONNECTED != r.status {
+        r.mutex.Unlock()
+        return
+    }
+    r.setStatus(SC_DISCONNECTED)
+    r.mutex.Unlock()
+
+    r.report(EV_RECONNECTING)
+}
+
+
+
+/**
+ * Report that the current connection has gone away.
+ */
+func (r *reconnector) lostCurrent() {
+    r.lost(r.currentGeneration())
+}
+
+
+
+func (r *reconnector) currentGeneration() int {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    return r.generation
+}
+
+
+
+/**
+ * Redial straight away, even after giving up.  Used when the operator
+ * presses the key while disconnected.
+ */
+func (r *reconnector) retryNow() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if SC_FAILED == r.status {
+        r.setStatus(SC_RECONNECTING)
+        r.attempts = 0
+    }
+    r.nextAttempt = r.clock.now()
+}
+
+
+
+func (r *reconnector) report(event string) {
+    if event != "" && r.onEvent != nil {
+        r.onEvent(event)
+    }
+}
+
+/* end of file */
@@ -0,0 +1,150 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+
+
+// a reconnector without jitter on a fake clock, and the events it reports
+func newTestReconnector(config ReconnectConfig) (*reconnector, *fakeClock, *[]string) {
+    fc := newFakeClock(time.Unix(1000, 0))
+    var events []string
+    r := newReconnector(config, fc, func(event string) {
+        events = append(events, event)
+    })
+    return r, fc, &events
+}
+
+
+
+func testReconnectConfig() ReconnectConfig {
+    return ReconnectConfig{InitialDelayMs: 1000, MaxDelayMs: 4000, SilentAttempts: 2, AlertAfter: 4}
+}
+
+
+
+func TestReconnectorBacksOffAfterSilentAttempts(t *testing.T) {
+    r, fc, _ := newTestReconnector(testReconnectConfig())
+    want := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}
+
+    for attempt, delay := range want {
+        if !r.due() {
+            t.Fatalf("attempt %d not due", attempt + 1)
+        }
+        r.dialing()
+        r.dialFailed()
+        if delay > 0 {
+            fc.advance(delay - time.Millisecond)
+            if r.due() {
+                t.Fatalf("attempt %d due before %v", attempt + 2, delay)
+            }
+            fc.advance(time.Millisecond)
+        }
+    }
+    if !r.due() {
+        t.Error("last attempt not due after its delay")
+    }
+}
+
+
+
+func TestReconnectorReportsOutagesAndRecovery(t *testing.T) {
+    r, _, events := newTestReconnector(testReconnectConfig())
+    r.dialing()
+    r.connected(nil)
+    r.lostCurrent()
+
+    r.dialing()
+    r.dialFailed()
+    r.connected(nil)                            // back before the outage alert
+    r.lostCurrent()
+
+    r.dialing()
+    for i := 0; i < 4; i++ {
+        r.dialFailed()
+    }
+    r.connected(nil)                            // back after it
+
+    want := []string{EV_CONNECTED, EV_RECONNECTING, EV_RECONNECTED, EV_RECONNECTING, EV_OUTAGE, EV_RESTORED}
+    if !reflect.DeepEqual(*events, want) {
+        t.Errorf("reported %v, want %v", *events, want)
+    }
+}
+
+
+
+func TestReconnectorGivesUpUntilRetried(t *testing.T) {
+    config := testReconnectConfig()
+    config.GiveUpAfter = 3
+    r, fc, events := newTestReconnector(config)
+    r.dialing()
+    for i := 0; i < 3; i++ {
+        r.dialFailed()
+    }
+    if SC_FAILED != r.state() {
+        t.Fatalf("state %q after giving up, want %q", r.state(), SC_FAILED)
+    }
+    if last := (*events)[len(*events) - 1]; EV_UNREACHABLE != last {
+        t.Errorf("reported %q on giving up, want %q", last, EV_UNREACHABLE)
+    }
+    fc.advance(time.Hour)
+    if r.due() {
+        t.Error("redial due after giving up")
+    }
+
+    r.retryNow()
+    if SC_RECONNECTING != r.state() || !r.due() {
+        t.Errorf("after retryNow state %q, due %v; want %q and due", r.state(), r.due(), SC_RECONNECTING)
+    }
+}
+
+
+
+func TestReconnectorIgnoresLossOfOldConnections(t *testing.T) {
+    r, _, _ := newTestReconnector(testReconnectConfig())
+    r.dialing()
+    r.connected(nil)
+    old := r.currentGeneration()
+    r.lost(old)
+    r.dialing()
+    r.connected(nil)
+
+    r.lost(old)
+    if SC_CONNECTED != r.state() {
+        t.Errorf("state %q after an old connection was lost, want %q", r.state(), SC_CONNECTED)
+    }
+}
+
+
+
+func TestReconnectorSupervisesTheReceiver(t *testing.T) {
+    r, _, events := newTestReconnector(testReconnectConfig())
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    r.onEvent = func(event string) {
+        *events = append(*events, event)
+        if EV_RECONNECTING == event {
+            close(stopped)
+        }
+    }
+    r.dialing()
+    r.connected(func() error {
+        <-stop
+        panic("receiver failed")
+    })
+    close(stop)
+
+    select {
+    case <-stopped:
+    case <-time.After(time.Second):
+        t.Fatal("connection not reported lost when its receiver panicked")
+    }
+    if SC_DISCONNECTED != r.state() {
+        t.Errorf("state %q after the receiver stopped, want %q", r.state(), SC_DISCONNECTED)
+    }
+}
+
+/* end of file */
@@ -0,0 +1,309 @@
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+
+
+// session log format
+const(
+    SESSION_HEADER  = "# internet-telegraph session 1"  // first line of every file
+    SENDER_LOCAL    = "local"                           // sender of the local key's events
+    )
+
+
+
+/**
+ * Session recording, read from the "recorder" section of config.json.
+ */
+type RecorderConfig struct {
+    Path        string  `json:"path"`       // session log, "" to record nothing
+    MaxKB       int     `json:"maxKB"`      // start a new file after this much, 0 for no limit
+    Keep        int     `json:"keep"`       // full files kept, as path.1 (newest) to path.<keep>
+}
+
+
+
+func defaultRecorderConfig() RecorderConfig {
+    return RecorderConfig{MaxKB: 1024, Keep: 5}
+}
+
+
+
+/**
+ * One key event passing through a client or the server.
+ */
+type sessionEvent struct {
+    Received    time.Time       // when it was seen here
+    Channel     string
+    Sender      string          // sender id, SENDER_LOCAL for the local key
+    Down        bool
+    SentUs      int64           // the sender's timestamp, in microseconds
+}
+
+
+
+// the sender's timestamp in a key message such as "1<us>v2", without the
+// sender id; 0 if it has none
+func messageSentUs(message string) int64 {
+    sent, _ := strconv.ParseInt(strings.TrimSuffix(message[1:], "v2"), 10, 64)
+    return sent
+}
+
+
+
+/**
+ * Appends key events to a session log, one line each:
+ *
+ *      <received us> <channel> <sender> <0|1> <sender's timestamp us>
+ *
+ * Times are microseconds since 1970 and the channel is URL path escaped,
+ * "-" if there is none.  Every line is written straight to the file, so
+ * a crash loses at most the line being written.  When the file reaches
+ * MaxKB it is renamed path.1, the older files move up one, and a new
+ * file is started.  Recording is off while no path is set.
+ */
+type sessionRecorder struct {
+    mutex       sync.Mutex
+    config      RecorderConfig
+    file        *os.File
+    size        int64
+}
+
+
+
+/**
+ * Create a session recorder.
+ *
+ * @param   config  where to record and how to rotate
+ * @return  r       the recorder, usable even if the log could not be opened
+ * @return  error   set if the log could not be opened
+ */
+func newSessionRecorder(config RecorderConfig) (*sessionRecorder, error) {
+    r := &sessionRecorder{}
+    return r, r.setConfig(config)
+}
+
+
+
+/**
+ * Change where events are recorded.  The old file is closed.
+ *
+ * @param   config  where to record and how to rotate
+ * @return  error   set if the new log could not be opened
+ */
+func (r *sessionRecorder) setConfig(config RecorderConfig) error {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.closeFile()
+    r.config = config
+    if config.Path == "" {
+        return nil
+    }
+    if err := r.open(); err != nil {
+        return err
+    }
+    fmt.Println("Recording key events to", config.Path)
+    return nil
+}
+
+
+
+/**
+ * Record one event.  An error is logged and the event dropped, so a full
+ * disk never stops the telegraph.
+ *
+ * @param   e       the event
+ */
+func (r *sessionRecorder) record(e sessionEvent) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    if nil == r.file {
+        return
+    }
+    line := formatSessionEvent(e)
+    if r.config.MaxKB > 0 && r.size + int64(len(line)) > int64(r.config.MaxKB) * 1024 {
+        if err := r.rotate(); err != nil {
+            fmt.Println("Session log rotation failed:", err)
+            if nil == r.file {
+                return
+            }
+        }
+    }
+    n, err := r.file.WriteString(line)
+    r.size += int64(n)
+    if err != nil {
+        fmt.Println("Session log write failed:", err)
+    }
+}
+
+
+
+/**
+ * Stop recording.
+ */
+func (r *sessionRecorder) close() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.closeFile()
+}
+
+
+
+// close the file if one is open; the caller must hold the mutex
+func (r *sessionRecorder) closeFile() {
+    if r.file != nil {
+        r.file.Close()
+        r.file = nil
+    }
+}
+
+
+
+// open the log for appending, writing the header if it is new; the caller must hold the mutex
+func (r *sessionRecorder) open() error {
+    file, err := os.OpenFile(r.config.Path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0644)
+    if err != nil {
+        return err
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return err
+    }
+    r.file, r.size = file, info.Size()
+    if 0 == r.size {
+        n, err := r.file.WriteString(SESSION_HEADER + "\n")
+        r.size += int64(n)
+        return err
+    }
+    return nil
+}
+
+
+
+// move the full log aside and start a new one, or keep appending to it if it
+// cannot be moved; the caller must hold the mutex
+func (r *sessionRecorder) rotate() error {
+    r.closeFile()
+    path := r.config.Path
+    if r.config.Keep < 1 {
+        os.Remove(path)
+    } else {
+        os.Remove(path + "." + strconv.Itoa(r.config.Keep))
+        for n := r.config.Keep - 1; n >= 1; n-- {
+            os.Rename(path + "." + strconv.Itoa(n), path + "." + strconv.Itoa(n + 1))
+        }
+        if err := os.Rename(path, path + ".1"); err != nil {
+            if openErr := r.open(); openErr != nil {
+                return openErr
+            }
+            return err
+        }
+    }
+    return r.open()
+}
+
+
+
+// one event as a line of the session log
+func formatSessionEvent(e sessionEvent) string {
+    channel := url.PathEscape(e.Channel)
+    if channel == "" {
+        channel = "-"
+    }
+    state := "0"
+    if e.Down {
+        state = "1"
+    }
+    return fmt.Sprintf("%d %s %s %s %d\n", e.Received.UnixNano() / int64(time.Microsecond),
+                       channel, e.Sender, state, e.SentUs)
+}
+
+
+
+/**
+ * Parse one line of a session log.
+ *
+ * @param   line    the line, without its newline
+ * @return  sessionEvent    the event
+ * @return  error   set if the line is not an event
+ */
+func parseSessionEvent(line string) (sessionEvent, error) {
+    fields := strings.Fields(line)
+    if len(fields) != 5 || (fields[3] != "0" && fields[3] != "1") {
+        return sessionEvent{}, errors.New("not a key event")
+    }
+    received, err := strconv.ParseInt(fields[0], 10, 64)
+    if err != nil {
+        return sessionEvent{}, err
+    }
+    sent, err := strconv.ParseInt(fields[4], 10, 64)
+    if err != nil {
+        return sessionEvent{}, err
+    }
+    channel, err := url.PathUnescape(fields[1])
+    if err != nil {
+        return sessionEvent{}, err
+    }
+    if channel == "-" {
+        channel = ""
+    }
+    return sessionEvent{
+        Received:   time.Unix(0, received * int64(time.Microsecond)),
+        Channel:    channel,
+        Sender:     fields[2],
+        Down:       fields[3] == "1",
+        SentUs:     sent,
+    }, nil
+}
+
+
+
+/**
+ * Read a session log.  Comment lines are skipped, and so are lines that
+ * cannot be parsed, such as one cut short by a crash; they are counted in
+ * the log.
+ *
+ * @param   path    the session log
+ * @return  []sessionEvent  the events, in the order they were recorded
+ * @return  error   set if the file could not be read
+ */
+func readSession(path string) ([]sessionEvent, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    var events []sessionEvent
+    bad := 0
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        e, err := parseSessionEvent(line)
+        if err != nil {
+            bad++
+            continue
+        }
+        events = append(events, e)
+    }
+    if bad > 0 {
+        fmt.Println(path + ":", bad, "lines skipped")
+    }
+    return events, scanner.Err()
+}
+
+/* end of file */
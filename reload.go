@@ -0,0 +1,118 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "reflect"
+    "time"
+)
+
+
+
+// how often the config file is checked for changes
+const configWatchInterval = 2 * time.Second
+
+
+
+/**
+ * Re-reads the configuration when config.json changes or on SIGHUP and
+ * hands the new configuration to the client to apply.
+ *
+ * The same command line arguments are used for every load, so flags
+ * and environment variables keep overriding the file after a reload.
+ * A configuration that does not load or validate is reported and
+ * ignored; the client keeps running with what it had.
+ */
+type configReloader struct {
+    args        []string
+    path        string
+    current     Config
+    modTime     time.Time
+    size        int64
+    apply       func(old, new Config)
+    failed      func(err error)
+}
+
+
+
+/**
+ * Create a config reloader.
+ *
+ * @param   args    command line arguments the configuration was loaded with
+ * @param   path    config file to watch, "" if there is none
+ * @param   current the configuration in use
+ * @param   apply   called with the old and new configuration after a
+ *                  successful reload that changed something
+ * @param   failed  called when a reload fails
+ * @return  cr      the config reloader
+ */
+func newConfigReloader(args []string, path string, current Config,
+                       apply func(old, new Config), failed func(err error)) *configReloader {
+    cr := &configReloader{args: args, path: path, current: current, apply: apply, failed: failed}
+    cr.modTime, cr.size = fileStamp(path)
+    return cr
+}
+
+
+
+func fileStamp(path string) (time.Time, int64) {
+    if path == "" {
+        return time.Time{}, 0
+    }
+    info, err := os.Stat(path)
+    if err != nil {
+        return time.Time{}, 0
+    }
+    return info.ModTime(), info.Size()
+}
+
+
+
+/**
+ * Reload if the config file has changed.  Scheduler task.
+ */
+func (cr *configReloader) checkFile() {
+    modTime, size := fileStamp(cr.path)
+    if modTime.IsZero() || (modTime.Equal(cr.modTime) && size == cr.size) {
+        return
+    }
+    cr.modTime, cr.size = modTime, size
+    cr.reload(cr.path + " changed")
+}
+
+
+
+/**
+ * Load the configuration again and apply it if anything changed.
+ *
+ * @param   reason  why the reload is happening, for the log
+ */
+func (cr *configReloader) reload(reason string) {
+    fmt.Println("Reloading configuration:", reason)
+
+    config, source, err := loadConfiguration(cr.args)
+    if err != nil {
+        fmt.Println("Configuration not reloaded:")
+        fmt.Println(err)
+        if cr.failed != nil {
+            cr.failed(err)
+        }
+        return
+    }
+    if source.path != cr.path {
+        cr.path = source.path
+        cr.modTime, cr.size = fileStamp(cr.path)
+    }
+
+    if reflect.DeepEqual(config, cr.current) {
+        fmt.Println("Configuration unchanged")
+        return
+    }
+    fmt.Println(config.printable())
+
+    old := cr.current
+    cr.current = config
+    cr.apply(old, config)
+}
+
+/* end of file */
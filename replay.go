@@ -0,0 +1,335 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/stianeikeland/go-rpio"
+    "golang.org/x/net/websocket"
+)
+
+
+
+/**
+ * Somewhere a replayed session is keyed.
+ */
+type replayOutput interface {
+    key(sender string, down bool)
+    close()
+}
+
+
+
+/**
+ * Play a recorded session with its original timing.
+ *
+ *      telegraph-tool replay [-config config.json] [-speed 1] [-seek 0s]
+ *                            [-channel name] [-sender id] [-inject] [-to channel] session.log
+ *
+ * The session is played through the outputs in the config file: the
+ * software audio, each sender with its own voice, or the sounder on
+ * spkrPin when gpio is true.  With -inject it is sent into a channel
+ * on the configured server instead, each recorded sender as a station
+ * of its own.
+ *
+ * @param   args    the command line after "replay"
+ * @return  error   set if the session could not be played
+ */
+func replayCommand(args []string) error {
+    flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+    configPath := flags.String("config", "config.json", "telegraph config file with the outputs, server and channel")
+    speed := flags.Float64("speed", 1, "playback speed, 2 for twice as fast")
+    seek := flags.Duration("seek", 0, "start this far into the session, e.g. 1m30s")
+    channel := flags.String("channel", "", "only replay events recorded on this channel")
+    sender := flags.String("sender", "", "only replay events from this sender id")
+    inject := flags.Bool("inject", false, "send the session into a channel instead of playing it here")
+    to := flags.String("to", "", "channel to inject into, instead of the one in the config file")
+    if err := flags.Parse(args); err != nil {
+        return err
+    }
+    if flags.NArg() != 1 {
+        return errors.New("give one session log to replay")
+    }
+    if *speed <= 0 {
+        return errors.New("speed must be more than 0")
+    }
+    config, err := loadToolConfig(*configPath)
+    if err != nil {
+        return err
+    }
+    events, err := readSession(flags.Arg(0))
+    if err != nil {
+        return err
+    }
+    events = selectEvents(events, *channel, *sender)
+    if 0 == len(events) {
+        return errors.New("no key events to replay")
+    }
+
+    var out replayOutput
+    switch {
+    case *inject:
+        if *to != "" {
+            config.Channel = *to
+        }
+        out = newChannelReplay(config)
+    case config.Gpio:
+        out, err = newSounderReplay(config)
+    default:
+        out, err = newAudioReplay(config)
+    }
+    if err != nil {
+        return err
+    }
+    defer out.close()
+
+    fmt.Println("Replaying", len(events), "key events, from", events[0].Received.Format(time.RFC1123),
+                "to", events[len(events) - 1].Received.Format(time.RFC1123))
+    replaySession(events, *speed, *seek, systemClock{}, out)
+    return nil
+}
+
+
+
+/**
+ * The events recorded on one channel, from one sender, or both.
+ *
+ * @param   events  the session
+ * @param   channel the channel, "" for all
+ * @param   sender  the sender id, "" for all
+ * @return  []sessionEvent  the events that match
+ */
+func selectEvents(events []sessionEvent, channel string, sender string) []sessionEvent {
+    var selected []sessionEvent
+    for _, e := range events {
+        if (channel == "" || channel == e.Channel) && (sender == "" || sender == e.Sender) {
+            selected = append(selected, e)
+        }
+    }
+    return selected
+}
+
+
+
+// how far a sender's timestamps may wander from when its events arrived
+// before they are lined up again, e.g. when the server reuses its id
+const maxSenderDrift = 5 * time.Second
+
+
+
+// a recorded event and when it was keyed
+type timedEvent struct {
+    at      time.Time
+    sessionEvent
+}
+
+
+
+/**
+ * Work out when each event was keyed.  Events are timed by their
+ * senders' own timestamps, which network and server delays do not
+ * disturb, with each sender's clock lined up with the recording's at
+ * its first event.  Events without a timestamp keep the time they were
+ * received.
+ *
+ * @param   events  the session, in the order recorded
+ * @return  []timedEvent    the events in the order they were keyed
+ */
+func senderTiming(events []sessionEvent) []timedEvent {
+    offsets := make(map[string]time.Duration)
+    timed := make([]timedEvent, 0, len(events))
+    for _, e := range events {
+        at := e.Received
+        if e.SentUs > 0 {
+            sent := time.Unix(0, e.SentUs * int64(time.Microsecond))
+            offset, ok := offsets[e.Sender]
+            if drift := e.Received.Sub(sent.Add(offset)); !ok || drift > maxSenderDrift || drift < -maxSenderDrift {
+                offset = e.Received.Sub(sent)
+                offsets[e.Sender] = offset
+            }
+            at = sent.Add(offset)
+        }
+        timed = append(timed, timedEvent{at: at, sessionEvent: e})
+    }
+    sort.SliceStable(timed, func(i, j int) bool {
+        return timed[i].at.Before(timed[j].at)
+    })
+    return timed
+}
+
+
+
+/**
+ * Key the events at the times they were keyed, scaled by the speed.
+ * Events before the seek point are skipped, and every sender's key is
+ * let up at the end.
+ *
+ * @param   events  the session, in the order recorded
+ * @param   speed   playback speed, 1 for the original timing
+ * @param   seek    how far into the session to start
+ * @param   c       clock the events are timed by
+ * @param   out     where the events are keyed
+ */
+func replaySession(events []sessionEvent, speed float64, seek time.Duration, c clock, out replayOutput) {
+    timed := senderTiming(events)
+    from := timed[0].at.Add(seek)
+    started := c.now()
+    down := make(map[string]bool)
+    for _, e := range timed {
+        if e.at.Before(from) {
+            continue
+        }
+        due := started.Add(time.Duration(float64(e.at.Sub(from)) / speed))
+        c.sleep(due.Sub(c.now()))
+        out.key(e.Sender, e.Down)
+        down[e.Sender] = e.Down
+    }
+    for sender, isDown := range down {
+        if isDown {
+            out.key(sender, false)                 // never leave a key held down
+        }
+    }
+}
+
+
+
+// replays through the software audio, each sender with its own voice
+type audioReplay struct {
+    audio       *toneGenerator
+}
+
+
+
+func newAudioReplay(config toolConfig) (*audioReplay, error) {
+    sink, err := newPCMSink(config.Audio)
+    if err != nil {
+        return nil, err
+    }
+    audio := newToneGenerator(config.Audio, sink, systemClock{})
+    audio.setChannel(config.Channel)
+    go audio.run()
+    return &audioReplay{audio: audio}, nil
+}
+
+func (r *audioReplay) key(sender string, down bool) {
+    if SENDER_LOCAL == sender {
+        r.audio.key(down)                       // the recording client's own key, as its side tone
+    } else {
+        r.audio.keyStation(sender, down)
+    }
+}
+
+func (r *audioReplay) close() {
+    time.Sleep(2 * audioBlock)                  // let the last key up ring out
+    r.audio.stop()
+}
+
+
+
+// replays through the sounder, on while any sender's key is down
+type sounderReplay struct {
+    spkr        ledBackend
+    down        map[string]bool
+}
+
+
+
+func newSounderReplay(config toolConfig) (*sounderReplay, error) {
+    if err := rpio.Open(); err != nil {
+        return nil, fmt.Errorf("opening GPIO: %v", err)
+    }
+    return &sounderReplay{spkr: newToneOutput(config.SpkrPin, false, config.ToneHz, config.ToneDuty),
+                          down: make(map[string]bool)}, nil
+}
+
+func (r *sounderReplay) key(sender string, down bool) {
+    r.down[sender] = down
+    on := false
+    for _, isDown := range r.down {
+        on = on || isDown
+    }
+    r.spkr.set(on)
+}
+
+func (r *sounderReplay) close() {
+    r.spkr.set(false)
+    rpio.Close()
+}
+
+
+
+/**
+ * Replays into a channel.  Each recorded sender gets a connection of its
+ * own, so the server gives it a sender id and other clients hear it as
+ * a separate station.  Messages are in the v2 format, stamped with the
+ * time they are sent.
+ */
+type channelReplay struct {
+    url         string
+    mutex       sync.Mutex
+    stations    map[string]*websocket.Conn
+}
+
+
+
+func newChannelReplay(config toolConfig) *channelReplay {
+    return &channelReplay{
+        url:        "ws://" + config.Server + ":" + config.Port + "/channel/" + config.Channel,
+        stations:   make(map[string]*websocket.Conn),
+    }
+}
+
+func (r *channelReplay) key(sender string, down bool) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    conn, ok := r.stations[sender]
+    if !ok {
+        var err error
+        conn, err = websocket.Dial(r.url, "", "http://localhost")
+        if err != nil {
+            fmt.Println("Could not connect for sender", sender + ":", err)
+            r.stations[sender] = nil            // do not keep trying for every event
+            return
+        }
+        fmt.Println("Sender", sender, "connected to", r.url)
+        r.stations[sender] = conn
+        go drain(conn)
+    }
+    if nil == conn {
+        return
+    }
+    msg := "0"
+    if down {
+        msg = "1"
+    }
+    msg += strconv.FormatInt(time.Now().UnixNano() / int64(time.Microsecond), 10) + "v2"
+    if err := websocket.Message.Send(conn, msg); err != nil {
+        fmt.Println("Sending for sender", sender, "failed:", err)
+    }
+}
+
+func (r *channelReplay) close() {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    for _, conn := range r.stations {
+        if conn != nil {
+            conn.Close()
+        }
+    }
+}
+
+
+
+// read and discard what the server sends, so it is never held up by a replayed station
+func drain(conn *websocket.Conn) {
+    var msg string
+    for websocket.Message.Receive(conn, &msg) == nil {
+    }
+}
+
+/* end of file */
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "testing"
+    "time"
+)
+
+
+
+// replay output that notes when each event is keyed
+type fakeReplay struct {
+    clock   clock
+    start   time.Time
+    keyed   []string
+}
+
+func (r *fakeReplay) key(sender string, down bool) {
+    r.keyed = append(r.keyed, fmt.Sprintf("%s %v@%d", sender, down, r.clock.now().Sub(r.start) / time.Millisecond))
+}
+
+func (r *fakeReplay) close() {
+}
+
+
+
+// an event received at 'received' ms that its sender stamped 'sent' ms on its own clock
+func recordedEvent(sender string, down bool, received, sent int64) sessionEvent {
+    base := time.Unix(1000, 0)
+    return sessionEvent{
+        Received:   base.Add(time.Duration(received) * time.Millisecond),
+        Sender:     sender,
+        Down:       down,
+        SentUs:     sent * 1000,
+    }
+}
+
+
+
+func TestReplayTimesEventsBySender(t *testing.T) {
+    // 0001's events arrive with uneven network delay; 0002's clock is
+    // an hour out and one of its events has no timestamp
+    events := []sessionEvent{
+        recordedEvent("0001", true, 0, 5000000),
+        recordedEvent("0002", true, 40, 3600000),
+        recordedEvent("0001", false, 90, 5000060),
+        recordedEvent("0002", false, 200, 3600100),
+        recordedEvent("0001", true, 250, 5000120),
+        recordedEvent("0001", false, 300, 5000300),
+        recordedEvent("0002", true, 330, 0),
+        recordedEvent("0002", false, 450, 3600400),
+    }
+    fc := newFakeClock(time.Unix(2000, 0))
+    out := &fakeReplay{clock: fc, start: fc.now()}
+    replaySession(events, 1, 0, fc, out)
+
+    want := []string{"0001 true@0", "0002 true@40", "0001 false@60", "0001 true@120",
+                     "0002 false@140", "0001 false@300", "0002 true@330", "0002 false@440"}
+    if !reflect.DeepEqual(out.keyed, want) {
+        t.Errorf("replayed %v, want %v", out.keyed, want)
+    }
+}
+
+
+
+func TestReplaySpeedAndSeek(t *testing.T) {
+    events := []sessionEvent{
+        recordedEvent("0001", true, 0, 100),
+        recordedEvent("0001", false, 100, 200),
+        recordedEvent("0001", true, 200, 300),
+        recordedEvent("0001", false, 400, 500),
+    }
+    fc := newFakeClock(time.Unix(2000, 0))
+    out := &fakeReplay{clock: fc, start: fc.now()}
+    replaySession(events, 2, 150 * time.Millisecond, fc, out)
+
+    want := []string{"0001 true@25", "0001 false@125"}
+    if !reflect.DeepEqual(out.keyed, want) {
+        t.Errorf("replayed %v, want %v", out.keyed, want)
+    }
+}
+
+
+
+func TestReplayLetsHeldKeysUp(t *testing.T) {
+    events := []sessionEvent{recordedEvent("0001", true, 0, 100)}
+    fc := newFakeClock(time.Unix(2000, 0))
+    out := &fakeReplay{clock: fc, start: fc.now()}
+    replaySession(events, 1, 0, fc, out)
+
+    want := []string{"0001 true@0", "0001 false@0"}
+    if !reflect.DeepEqual(out.keyed, want) {
+        t.Errorf("replayed %v, want %v", out.keyed, want)
+    }
+}
+
+/* end of file */
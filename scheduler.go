@@ -0,0 +1,329 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+)
+
+
+
+/**
+ * A clock supplies the current time and ways to wait for time to pass.
+ *
+ * The scheduler and the other timing code ask a clock for the time instead
+ * of calling the time package directly.  That allows a fakeClock to be
+ * substituted so timing behaviour can be stepped through deterministically.
+ */
+type clock interface {
+    now() time.Time
+    sleep(d time.Duration)
+    afterFunc(d time.Duration, fn func())  // run fn in its own goroutine after d
+}
+
+
+
+// clock backed by the operating system timer
+type systemClock struct{}
+
+func (systemClock) now() time.Time {
+    return time.Now()
+}
+
+func (systemClock) sleep(d time.Duration) {
+    time.Sleep(d)
+}
+
+func (systemClock) afterFunc(d time.Duration, fn func()) {
+    time.AfterFunc(d, fn)
+}
+
+
+
+/**
+ * A clock that only moves when it is told to.
+ *
+ * Sleeping on a fakeClock advances it by the requested duration and
+ * returns immediately.  Functions passed to afterFunc() run on the
+ * goroutine that moves the clock past their time, in time order, and
+ * see the clock at their time while they run.
+ */
+type fakeClock struct {
+    mutex   sync.Mutex
+    current time.Time
+    timers  []fakeTimer
+}
+
+// a function waiting for a fakeClock to reach its time
+type fakeTimer struct {
+    due     time.Time
+    fn      func()
+}
+
+
+
+/**
+ * Create a fake clock starting at the given time.
+ *
+ * @param   start   the time the clock initially reports
+ * @return  fc      the fake clock
+ */
+func newFakeClock(start time.Time) *fakeClock {
+    return &fakeClock{current: start}
+}
+
+func (fc *fakeClock) now() time.Time {
+    fc.mutex.Lock()
+    defer fc.mutex.Unlock()
+    return fc.current
+}
+
+func (fc *fakeClock) sleep(d time.Duration) {
+    fc.advance(d)
+}
+
+func (fc *fakeClock) afterFunc(d time.Duration, fn func()) {
+    fc.mutex.Lock()
+    fc.timers = append(fc.timers, fakeTimer{due: fc.current.Add(d), fn: fn})
+    fc.mutex.Unlock()
+}
+
+func (fc *fakeClock) advance(d time.Duration) {
+    fc.mutex.Lock()
+    end := fc.current.Add(d)
+    for {
+        next := -1
+        for i, timer := range fc.timers {
+            if !timer.due.After(end) && (next < 0 || timer.due.Before(fc.timers[next].due)) {
+                next = i
+            }
+        }
+        if next < 0 {
+            break
+        }
+        timer := fc.timers[next]
+        fc.timers = append(fc.timers[:next], fc.timers[next+1:]...)
+        if timer.due.After(fc.current) {
+            fc.current = timer.due
+        }
+        fc.mutex.Unlock()
+        timer.fn()
+        fc.mutex.Lock()
+    }
+    fc.current = end
+    fc.mutex.Unlock()
+}
+
+
+
+/**
+ * A unit of work run by the scheduler.
+ *
+ * Periodic tasks have a non zero interval and are rescheduled after each
+ * run.  One-shot tasks have an interval of zero and are removed after
+ * they run.
+ */
+type task struct {
+    name        string
+    interval    time.Duration
+    next        time.Time
+    run         func()
+    runs        int
+    cancelled   bool
+}
+
+
+
+/**
+ * Runs periodic and one-shot tasks when they fall due.
+ *
+ * Tasks run one at a time on the goroutine that calls run() or
+ * runPending(), so a task never has to guard against another task.
+ * Tasks may add or cancel tasks while they run.
+ */
+type scheduler struct {
+    clock       clock
+    mutex       sync.Mutex
+    tasks       []*task
+    maxSleep    time.Duration   // longest the run loop sleeps between checks
+    stopped     bool
+}
+
+
+
+/**
+ * Create a scheduler driven by the given clock.
+ *
+ * @param   c       clock used to decide when tasks are due
+ * @return  s       the scheduler
+ */
+func newScheduler(c clock) *scheduler {
+    return &scheduler{clock: c, maxSleep: 100 * time.Millisecond}
+}
+
+
+
+/**
+ * Register a task that runs every 'interval', starting one interval
+ * from now.
+ *
+ * @param   name        name used when logging the task
+ * @param   interval    time between runs
+ * @param   fn          the work to do
+ * @return  t           handle that can be passed to cancel()
+ */
+func (s *scheduler) every(name string, interval time.Duration, fn func()) *task {
+    if interval <= 0 {
+        panic("scheduler: task " + name + " needs a positive interval")
+    }
+    t := &task{name: name, interval: interval, next: s.clock.now().Add(interval), run: fn}
+    s.add(t)
+    return t
+}
+
+
+
+/**
+ * Register a task that runs once after 'delay'.
+ *
+ * @param   name        name used when logging the task
+ * @param   delay       time to wait before running
+ * @param   fn          the work to do
+ * @return  t           handle that can be passed to cancel()
+ */
+func (s *scheduler) after(name string, delay time.Duration, fn func()) *task {
+    t := &task{name: name, next: s.clock.now().Add(delay), run: fn}
+    s.add(t)
+    return t
+}
+
+
+
+func (s *scheduler) add(t *task) {
+    s.mutex.Lock()
+    s.tasks = append(s.tasks, t)
+    s.mutex.Unlock()
+}
+
+
+
+/**
+ * Stop a task from running again.  Cancelling a nil or finished task
+ * does nothing.
+ *
+ * @param   t       task returned by every() or after()
+ */
+func (s *scheduler) cancel(t *task) {
+    if t == nil {
+        return
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    t.cancelled = true
+    for i, candidate := range s.tasks {
+        if candidate == t {
+            s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+            break
+        }
+    }
+}
+
+
+
+/**
+ * Run every task that is due, then report how long until the next one.
+ *
+ * A periodic task that overran more than one interval is not run again to
+ * catch up; it is rescheduled one interval from now.
+ *
+ * @return  wait    time until the next task is due, or maxSleep if
+ *                  nothing is scheduled
+ */
+func (s *scheduler) runPending() time.Duration {
+    now := s.clock.now()
+
+    s.mutex.Lock()
+    var due []*task
+    for _, t := range s.tasks {
+        if !t.next.After(now) {
+            due = append(due, t)
+        }
+    }
+    s.mutex.Unlock()
+
+    for _, t := range due {
+        s.mutex.Lock()
+        cancelled := t.cancelled
+        s.mutex.Unlock()
+        if cancelled {
+            continue
+        }
+        t.runs++
+        t.run()
+
+        if t.interval == 0 {
+            s.cancel(t)
+        } else {
+            s.mutex.Lock()
+            t.next = t.next.Add(t.interval)
+            if finished := s.clock.now(); !t.next.After(finished) {
+                t.next = finished.Add(t.interval)
+            }
+            s.mutex.Unlock()
+        }
+    }
+
+    return s.untilNext()
+}
+
+
+
+func (s *scheduler) untilNext() time.Duration {
+    now := s.clock.now()
+    wait := s.maxSleep
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    for _, t := range s.tasks {
+        if d := t.next.Sub(now); d < wait {
+            wait = d
+        }
+    }
+    if wait < 0 {
+        wait = 0
+    }
+    return wait
+}
+
+
+
+/**
+ * Run tasks as they fall due until stop() is called.
+ */
+func (s *scheduler) run() {
+    fmt.Println("scheduler running")
+    for !s.isStopped() {
+        if wait := s.runPending(); wait > 0 {
+            s.clock.sleep(wait)
+        }
+    }
+    fmt.Println("scheduler stopped")
+}
+
+
+
+func (s *scheduler) stop() {
+    s.mutex.Lock()
+    s.stopped = true
+    s.mutex.Unlock()
+}
+
+
+
+func (s *scheduler) isStopped() bool {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.stopped
+}
+
+/* end of file */
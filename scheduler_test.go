@@ -0,0 +1,139 @@
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+
+
+func TestSchedulerRunsPeriodicTasksEachInterval(t *testing.T) {
+    fc := newFakeClock(time.Unix(1000, 0))
+    s := newScheduler(fc)
+    var runs []time.Duration
+    start := fc.now()
+    s.every("tick", 300 * time.Millisecond, func() {
+        runs = append(runs, fc.now().Sub(start))
+    })
+
+    for i := 0; i < 10; i++ {
+        fc.advance(s.runPending())
+    }
+    want := []time.Duration{300 * time.Millisecond, 600 * time.Millisecond, 900 * time.Millisecond}
+    if !reflect.DeepEqual(runs[:3], want) {
+        t.Errorf("ran at %v, want %v first", runs, want)
+    }
+}
+
+
+
+func TestSchedulerRunsOneShotTasksOnce(t *testing.T) {
+    fc := newFakeClock(time.Unix(1000, 0))
+    s := newScheduler(fc)
+    runs := 0
+    s.after("once", 250 * time.Millisecond, func() {
+        runs++
+    })
+
+    fc.advance(200 * time.Millisecond)
+    s.runPending()
+    if runs != 0 {
+        t.Fatalf("ran %d times before it was due", runs)
+    }
+    for i := 0; i < 5; i++ {
+        fc.advance(100 * time.Millisecond)
+        s.runPending()
+    }
+    if runs != 1 {
+        t.Errorf("ran %d times, want once", runs)
+    }
+}
+
+
+
+func TestSchedulerCancelledTasksDoNotRun(t *testing.T) {
+    fc := newFakeClock(time.Unix(1000, 0))
+    s := newScheduler(fc)
+    runs := 0
+    var second *task
+    s.after("first", 100 * time.Millisecond, func() {
+        s.cancel(second)                        // tasks may cancel tasks due at the same time
+    })
+    second = s.after("second", 100 * time.Millisecond, func() {
+        runs++
+    })
+    periodic := s.every("periodic", 100 * time.Millisecond, func() {
+        runs++
+    })
+    s.cancel(periodic)
+    s.cancel(nil)
+
+    fc.advance(time.Second)
+    s.runPending()
+    if runs != 0 {
+        t.Errorf("cancelled tasks ran %d times", runs)
+    }
+}
+
+
+
+func TestSchedulerDoesNotCatchUpOverrunTasks(t *testing.T) {
+    fc := newFakeClock(time.Unix(1000, 0))
+    s := newScheduler(fc)
+    runs := 0
+    s.every("slow", 100 * time.Millisecond, func() {
+        runs++
+        if 1 == runs {
+            fc.advance(time.Second)             // overrun ten intervals
+        }
+    })
+
+    fc.advance(100 * time.Millisecond)
+    s.runPending()
+    if wait := s.runPending(); runs != 1 || wait != 100 * time.Millisecond {
+        t.Errorf("after an overrun: %d runs and next in %v, want 1 run and next in 100ms", runs, wait)
+    }
+}
+
+
+
+func TestSchedulerWaitsUntilTheNextTask(t *testing.T) {
+    fc := newFakeClock(time.Unix(1000, 0))
+    s := newScheduler(fc)
+    if wait := s.runPending(); wait != s.maxSleep {
+        t.Errorf("with nothing scheduled waits %v, want %v", wait, s.maxSleep)
+    }
+    s.after("soon", 30 * time.Millisecond, func() {})
+    if wait := s.runPending(); wait != 30 * time.Millisecond {
+        t.Errorf("waits %v for a task due in 30ms", wait)
+    }
+}
+
+
+
+func TestFakeClockRunsTimersInOrder(t *testing.T) {
+    start := time.Unix(1000, 0)
+    fc := newFakeClock(start)
+    var fired []time.Duration
+    note := func() {
+        fired = append(fired, fc.now().Sub(start))
+    }
+    fc.afterFunc(30 * time.Millisecond, note)
+    fc.afterFunc(10 * time.Millisecond, func() {
+        note()
+        fc.afterFunc(5 * time.Millisecond, note)   // timers may set timers
+    })
+    fc.afterFunc(100 * time.Millisecond, note)
+
+    fc.advance(50 * time.Millisecond)
+    want := []time.Duration{10 * time.Millisecond, 15 * time.Millisecond, 30 * time.Millisecond}
+    if !reflect.DeepEqual(fired, want) {
+        t.Errorf("timers fired at %v, want %v", fired, want)
+    }
+    if fc.now().Sub(start) != 50 * time.Millisecond {
+        t.Errorf("clock at %v after advancing 50ms", fc.now().Sub(start))
+    }
+}
+
+/* end of file */
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
@@ -19,6 +22,7 @@ type Client struct {
 var (
 	connections = make(map[*websocket.Conn]Client)
 	idCounter   = 0
+	recorder    *sessionRecorder
 )
 
 func addConnection(ws *websocket.Conn) {
@@ -114,13 +118,35 @@ func Echo(ws *websocket.Conn) {
 			fmt.Println("Received from client: " + incoming)
 			fmt.Println(ws.Request().URL.Path)
 			channel := ws.Request().URL.Path
+			record(incoming, channel, connections[ws].id)
 			incoming = incoming + fmt.Sprintf("%04d", connections[ws].id)
 			broadcastToChannel(incoming, ws, channel)
 		}
 	}
 }
 
+// Add a key event from a client to the session log
+func record(incoming string, channel string, id int) {
+	if len(incoming) < 2 || (incoming[:1] != "0" && incoming[:1] != "1") {
+		return
+	}
+	sentUs := messageSentUs(incoming)
+	recorder.record(sessionEvent{Received: time.Now(), Channel: strings.TrimPrefix(channel, "/channel/"),
+		Sender: fmt.Sprintf("%04d", id), Down: incoming[:1] == "1", SentUs: sentUs})
+}
+
 func main() {
+	defaults := defaultRecorderConfig()
+	recordPath := flag.String("record", "", "session log to record every key event to")
+	recordMaxKB := flag.Int("recordMaxKB", defaults.MaxKB, "start a new session log after this many KB, 0 for no limit")
+	recordKeep := flag.Int("recordKeep", defaults.Keep, "full session logs kept")
+	flag.Parse()
+
+	var recordErr error
+	recorder, recordErr = newSessionRecorder(RecorderConfig{Path: *recordPath, MaxKB: *recordMaxKB, Keep: *recordKeep})
+	checkError(recordErr)
+	defer recorder.close()
+
 	http.Handle("/channel/", websocket.Handler(Echo))
 	// var handlerErr = http.ListenAndServe(os.Getenv("OPENSHIFT_GO_IP")+":"+os.Getenv("OPENSHIFT_GO_PORT"), nil)
 	var handlerErr = http.ListenAndServe(":8000", nil)
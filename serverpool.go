@@ -0,0 +1,294 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+)
+
+
+
+// events reported when the client changes server
+const(
+    EV_FAILOVER     = "failover"        // moved down the server list
+    EV_FAILBACK     = "failback"        // moved back to a preferred server
+    )
+
+// how long a fail-back health check waits for a server to answer
+const probeTimeout = 3 * time.Second
+
+
+
+// one server a client can connect to
+type ServerConfig struct {
+    Server  string  `json:"server"`
+    Port    string  `json:"port"`
+}
+
+func (s ServerConfig) String() string {
+    return s.Server + ":" + s.Port
+}
+
+
+
+/**
+ * When to change server, read from the "failover" section of
+ * config.json.
+ */
+type FailoverConfig struct {
+    FailAfter   int     `json:"failAfter"`      // failed dials before trying the next server
+    FailbackSec int     `json:"failbackSec"`    // how often preferred servers are checked
+}
+
+
+
+func defaultFailoverConfig() FailoverConfig {
+    return FailoverConfig{FailAfter: 3, FailbackSec: 60}
+}
+
+
+
+/**
+ * An ordered list of servers, most preferred first, and which one is
+ * in use.
+ *
+ * The list comes from the DNS SRV record named by serverSrv, then the
+ * "servers" list, and falls back to the single server/port pair.  After
+ * FailAfter consecutive failed dials the next server is used, wrapping
+ * round to the first and looking the SRV record up again.  While a less
+ * preferred server is in use, checkFailback() probes the better ones
+ * and moves back as soon as one answers.
+ *
+ * SRV lookups wait on DNS, so they are made by refresh() in a goroutine
+ * of their own and the list is rebuilt from the last answer.
+ *
+ * A pool is retired when the configuration replaces it, so a check
+ * that was still probing then cannot move the client.
+ */
+type serverPool struct {
+    config      FailoverConfig
+    srvName     string
+    listed      []ServerConfig
+    fallback    ServerConfig
+    found       []ServerConfig      // SRV targets from the last lookup
+    probe       func(ServerConfig) bool
+
+    mutex       sync.Mutex
+    servers     []ServerConfig
+    active      int
+    failures    int
+    probing     bool
+    retired     bool
+}
+
+
+
+/**
+ * Create the server list described by the configuration.  The SRV
+ * record is not looked up until refresh() is called.
+ *
+ * @param   config  configuration settings
+ * @return  p       the server pool, using its most preferred server
+ */
+func newServerPool(config Config) *serverPool {
+    p := &serverPool{
+        config:     config.Failover,
+        srvName:    config.ServerSrv,
+        listed:     config.Servers,
+        fallback:   ServerConfig{Server: config.Server, Port: config.Port},
+        probe:      probeServer,
+    }
+    p.servers = p.build()
+    return p
+}
+
+
+
+/**
+ * Look the SRV record up and rebuild the server list.  The server in
+ * use keeps being used; if it is no longer listed the most preferred
+ * server is used instead.  This waits on DNS, so it should not be run
+ * on the scheduler goroutine.
+ */
+func (p *serverPool) refresh() {
+    if p.srvName == "" {
+        return
+    }
+    var found []ServerConfig
+    _, records, err := net.LookupSRV("telegraph", "tcp", p.srvName)
+    if err != nil {
+        fmt.Println("SRV lookup for", p.srvName, "failed:", err)
+    }
+    for _, record := range records {
+        host := record.Target
+        if n := len(host); n > 0 && host[n-1] == '.' {
+            host = host[:n-1]
+        }
+        found = append(found, ServerConfig{Server: host, Port: strconv.Itoa(int(record.Port))})
+    }
+
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    inUse := p.servers[p.active]
+    p.found = found
+    p.servers = p.build()
+    p.active = 0
+    for i, server := range p.servers {
+        if server == inUse {
+            p.active = i
+            break
+        }
+    }
+    fmt.Println("servers:", p.servers)
+}
+
+
+
+/**
+ * Build the server list: SRV targets in the order DNS gave them, then
+ * the configured list, then the single server if there is nothing else.
+ */
+func (p *serverPool) build() []ServerConfig {
+    var servers []ServerConfig
+    servers = append(servers, p.found...)
+    servers = append(servers, p.listed...)
+    if len(servers) == 0 {
+        servers = append(servers, p.fallback)
+    }
+    return servers
+}
+
+
+
+/**
+ * The server in use.
+ */
+func (p *serverPool) current() ServerConfig {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return p.servers[p.active]
+}
+
+
+
+/**
+ * Position of the server in use, counting the most preferred as 1.
+ */
+func (p *serverPool) position() int {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return p.active + 1
+}
+
+
+
+/**
+ * Record a successful dial.
+ */
+func (p *serverPool) dialSucceeded() {
+    p.mutex.Lock()
+    p.failures = 0
+    p.mutex.Unlock()
+}
+
+
+
+/**
+ * Record a failed dial and move to the next server after too many.
+ *
+ * @return  bool    true if the server in use changed
+ */
+func (p *serverPool) dialFailed() bool {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    p.failures++
+    if p.failures < p.config.FailAfter {
+        return false
+    }
+    p.failures = 0
+
+    from := p.servers[p.active]
+    p.active++
+    if p.active >= len(p.servers) {
+        p.active = 0
+        go p.refresh()                  // takes effect by the next round
+    }
+    to := p.servers[p.active]
+    if to == from {
+        return false
+    }
+    fmt.Println("Failing over from", from, "to", to)
+    return true
+}
+
+
+
+/**
+ * Stop the pool changing server.  Called when a new pool replaces it.
+ */
+func (p *serverPool) retire() {
+    p.mutex.Lock()
+    p.retired = true
+    p.mutex.Unlock()
+}
+
+
+
+/**
+ * Check whether a more preferred server has come back and switch to
+ * it.  The checks make network connections, so this should not be run
+ * on the scheduler goroutine.
+ *
+ * @return  bool    true if the server in use changed
+ */
+func (p *serverPool) checkFailback() bool {
+    p.mutex.Lock()
+    if p.probing || p.retired || p.active == 0 {
+        p.mutex.Unlock()
+        return false
+    }
+    p.probing = true
+    better := append([]ServerConfig(nil), p.servers[:p.active]...)
+    p.mutex.Unlock()
+
+    defer func() {
+        p.mutex.Lock()
+        p.probing = false
+        p.mutex.Unlock()
+    }()
+
+    for i, server := range better {
+        if !p.probe(server) {
+            continue
+        }
+        p.mutex.Lock()
+        defer p.mutex.Unlock()
+        if p.retired || i >= p.active || p.servers[i] != server {
+            return false                        // the list changed while probing
+        }
+        fmt.Println("Failing back from", p.servers[p.active], "to", server)
+        p.active = i
+        p.failures = 0
+        return true
+    }
+    return false
+}
+
+
+
+/**
+ * Report whether a server accepts TCP connections.
+ */
+func probeServer(server ServerConfig) bool {
+    conn, err := net.DialTimeout("tcp", net.JoinHostPort(server.Server, server.Port), probeTimeout)
+    if err != nil {
+        return false
+    }
+    conn.Close()
+    return true
+}
+
+/* end of file */
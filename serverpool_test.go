@@ -0,0 +1,146 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+
+
+var testServers = []ServerConfig{
+    {"one.example.org", "8000"},
+    {"two.example.org", "8000"},
+    {"three.example.org", "8000"},
+}
+
+
+
+// a pool of the test servers where only the servers in 'up' answer probes
+func newTestPool(up map[string]bool) *serverPool {
+    p := newServerPool(Config{Servers: testServers, Failover: FailoverConfig{FailAfter: 2, FailbackSec: 60}})
+    p.probe = func(server ServerConfig) bool {
+        return up[server.Server]
+    }
+    return p
+}
+
+
+
+// fail dials until the pool moves on, and report where it moved
+func failOver(t *testing.T, p *serverPool) int {
+    if p.dialFailed() {
+        t.Fatalf("failed over after one failed dial")
+    }
+    if !p.dialFailed() {
+        t.Fatalf("still on server %d after %d failed dials", p.position(), p.config.FailAfter)
+    }
+    return p.position()
+}
+
+
+
+func TestServerPoolFailsOverInOrder(t *testing.T) {
+    p := newTestPool(nil)
+    if p.position() != 1 || p.current() != testServers[0] {
+        t.Fatalf("started on server %d, %v", p.position(), p.current())
+    }
+    for _, want := range []int{2, 3, 1, 2} {
+        if got := failOver(t, p); got != want {
+            t.Errorf("failed over to server %d, want %d", got, want)
+        }
+    }
+}
+
+
+
+func TestServerPoolSuccessfulDialResetsTheFailures(t *testing.T) {
+    p := newTestPool(nil)
+    p.dialFailed()
+    p.dialSucceeded()
+    if p.dialFailed() || p.position() != 1 {
+        t.Errorf("on server %d after failures either side of a good dial", p.position())
+    }
+}
+
+
+
+func TestServerPoolFailsBackToTheBestServerThatAnswers(t *testing.T) {
+    up := map[string]bool{}
+    p := newTestPool(up)
+    failOver(t, p)
+    failOver(t, p)
+
+    if p.checkFailback() || p.position() != 3 {
+        t.Fatalf("failed back to server %d when nothing answered", p.position())
+    }
+    up["two.example.org"] = true
+    if !p.checkFailback() || p.position() != 2 {
+        t.Fatalf("on server %d after server 2 answered", p.position())
+    }
+    up["one.example.org"] = true
+    if !p.checkFailback() || p.position() != 1 {
+        t.Fatalf("on server %d after server 1 answered", p.position())
+    }
+    if p.checkFailback() {
+        t.Error("failed back from the most preferred server")
+    }
+}
+
+
+
+func TestServerPoolDoesNotFailBackOnceRetired(t *testing.T) {
+    p := newTestPool(map[string]bool{"one.example.org": true})
+    failOver(t, p)
+    p.retire()
+    if p.checkFailback() || p.position() != 2 {
+        t.Errorf("a retired pool failed back to server %d", p.position())
+    }
+}
+
+
+
+func TestServerPoolIgnoresAProbeThatFinishesAfterARetune(t *testing.T) {
+    p := newTestPool(nil)
+    probing, answer := make(chan struct{}), make(chan bool)
+    p.probe = func(server ServerConfig) bool {
+        close(probing)
+        return <-answer
+    }
+    failOver(t, p)
+
+    done := make(chan bool)
+    go func() {
+        done <- p.checkFailback()
+    }()
+    <-probing
+    if p.checkFailback() {
+        t.Error("a second check ran while the first was probing")
+    }
+    p.retire()                                  // the configuration replaced the pool
+    answer <- true
+
+    select {
+    case moved := <-done:
+        if moved || p.position() != 2 {
+            t.Errorf("failed back to server %d after the pool was retired", p.position())
+        }
+    case <-time.After(time.Second):
+        t.Fatal("the check did not finish")
+    }
+}
+
+
+
+func TestServerPoolUsesTheSingleServerWithoutAList(t *testing.T) {
+    p := newServerPool(Config{Server: "solo.example.org", Port: "8001", Failover: defaultFailoverConfig()})
+    if p.current() != (ServerConfig{"solo.example.org", "8001"}) {
+        t.Errorf("using %v", p.current())
+    }
+    for i := 0; i < 3; i++ {
+        if p.dialFailed() {
+            t.Error("failed over with only one server")
+        }
+    }
+}
+
+/* end of file */
@@ -0,0 +1,215 @@
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "math"
+    "math/rand"
+)
+
+
+
+// what the software audio sounds like
+const(
+    VOICE_TONE      = "tone"        // a keyed sine wave
+    VOICE_SOUNDER   = "sounder"     // a click on key down and a clack on key up
+    )
+
+
+
+/**
+ * One resonance of a synthesized sounder sample: a sine wave that dies
+ * away exponentially.
+ */
+type resonance struct {
+    hz      float64
+    decayMs float64             // time to fall to 1/e
+    level   float64
+}
+
+
+
+// the armature striking the bottom stop: a sharp, bright click
+var clickResonances = []resonance{
+    {hz: 2400, decayMs: 5, level: 0.6},
+    {hz: 1150, decayMs: 14, level: 1.0},
+    {hz: 380, decayMs: 28, level: 0.5},
+}
+
+// the armature thrown back against the top stop: a duller, longer clack
+var clackResonances = []resonance{
+    {hz: 1700, decayMs: 7, level: 0.5},
+    {hz: 820, decayMs: 20, level: 1.0},
+    {hz: 260, decayMs: 40, level: 0.6},
+}
+
+
+
+/**
+ * The down click and up clack samples for the sounder voice, as levels
+ * from -1 to 1 at the audio sample rate.  A WAV file named in the config
+ * is used in place of the built in sample; if it cannot be read the
+ * built in one is used and the problem logged.
+ *
+ * @param   config  audio settings
+ * @return  click   the key down sample
+ * @return  clack   the key up sample
+ */
+func sounderSamples(config AudioConfig) ([]float64, []float64) {
+    click := synthesizeStrike(clickResonances, 60, config.SampleRate, 1)
+    clack := synthesizeStrike(clackResonances, 80, config.SampleRate, 2)
+    if config.ClickPath != "" {
+        sample, err := loadWavSample(config.ClickPath, config.SampleRate)
+        if err != nil {
+            fmt.Println("Using the built in click:", err)
+        } else {
+            click = sample
+        }
+    }
+    if config.ClackPath != "" {
+        sample, err := loadWavSample(config.ClackPath, config.SampleRate)
+        if err != nil {
+            fmt.Println("Using the built in clack:", err)
+        } else {
+            clack = sample
+        }
+    }
+    return click, clack
+}
+
+
+
+/**
+ * Synthesize the sound of the armature striking a stop: a short burst of
+ * noise for the impact, ringing the resonances of the frame.
+ *
+ * @param   resonances  the ringing
+ * @param   lengthMs    length of the sample
+ * @param   sampleRate  samples per second
+ * @param   seed        for the noise, so the sample is the same every run
+ * @return  []float64   the sample, peaking at 0.9
+ */
+func synthesizeStrike(resonances []resonance, lengthMs float64, sampleRate int, seed int64) []float64 {
+    noise := rand.New(rand.NewSource(seed))
+    sample := make([]float64, int(lengthMs * float64(sampleRate) / 1000))
+    var peak float64
+    for i := range sample {
+        ms := float64(i) * 1000 / float64(sampleRate)
+        level := 0.4 * (2 * noise.Float64() - 1) * math.Exp(-ms / 1.5)
+        for _, r := range resonances {
+            level += r.level * math.Exp(-ms / r.decayMs) * math.Sin(2 * math.Pi * r.hz * ms / 1000)
+        }
+        sample[i] = level
+        peak = math.Max(peak, math.Abs(level))
+    }
+    for i := range sample {
+        sample[i] *= 0.9 / peak
+    }
+    return sample
+}
+
+
+
+/**
+ * Read a 16 bit PCM WAV file as a mono sample at the audio sample rate.
+ * Stereo files are mixed down and other rates resampled.
+ *
+ * @param   path        the WAV file
+ * @param   sampleRate  the rate wanted
+ * @return  []float64   the sample, levels from -1 to 1
+ * @return  error       set if the file is not a 16 bit PCM WAV file
+ */
+func loadWavSample(path string, sampleRate int) ([]float64, error) {
+    mono, rate, err := readWav(path)
+    if err != nil {
+        return nil, err
+    }
+    return resample(mono, float64(rate) / float64(sampleRate)), nil
+}
+
+
+
+/**
+ * Read a 16 bit PCM WAV file, mixing stereo down to mono.
+ *
+ * @param   path        the WAV file
+ * @return  []float64   the samples, levels from -1 to 1
+ * @return  int         the file's sample rate
+ * @return  error       set if the file is not a 16 bit PCM WAV file
+ */
+func readWav(path string) ([]float64, int, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, 0, err
+    }
+    if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+        return nil, 0, fmt.Errorf("%s is not a WAV file", path)
+    }
+
+    var channels, rate, bits int
+    var pcm []byte
+    for at := 12; at + 8 <= len(data); {
+        id := string(data[at:at + 4])
+        size := int(binary.LittleEndian.Uint32(data[at + 4:at + 8]))
+        body := data[at + 8:]
+        if size > len(body) {
+            size = len(body)
+        }
+        body = body[:size]
+        switch id {
+        case "fmt ":
+            if size < 16 || 1 != binary.LittleEndian.Uint16(body[0:2]) {
+                return nil, 0, fmt.Errorf("%s is not PCM", path)
+            }
+            channels = int(binary.LittleEndian.Uint16(body[2:4]))
+            rate = int(binary.LittleEndian.Uint32(body[4:8]))
+            bits = int(binary.LittleEndian.Uint16(body[14:16]))
+        case "data":
+            pcm = body
+        }
+        at += 8 + size + size % 2               // chunks are padded to an even length
+    }
+    if 16 != bits || channels < 1 || rate < 1 {
+        return nil, 0, fmt.Errorf("%s: only 16 bit PCM is supported", path)
+    }
+    frames := len(pcm) / (2 * channels)
+    if 0 == frames {
+        return nil, 0, errors.New(path + " has no samples")
+    }
+
+    mono := make([]float64, frames)
+    for i := range mono {
+        for c := 0; c < channels; c++ {
+            at := 2 * (i * channels + c)
+            mono[i] += float64(int16(binary.LittleEndian.Uint16(pcm[at:]))) / math.MaxInt16
+        }
+        mono[i] /= float64(channels)
+    }
+    return mono, rate, nil
+}
+
+
+
+/**
+ * Resample by linear interpolation.
+ *
+ * @param   sample  the sample
+ * @param   step    input samples per output sample
+ * @return  []float64   the resampled sample
+ */
+func resample(sample []float64, step float64) []float64 {
+    if 1 == step {
+        return sample
+    }
+    var out []float64
+    for at := 0.0; at < float64(len(sample) - 1); at += step {
+        i := int(at)
+        fraction := at - float64(i)
+        out = append(out, sample[i] * (1 - fraction) + sample[i + 1] * fraction)
+    }
+    return out
+}
+
+/* end of file */
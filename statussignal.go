@@ -0,0 +1,296 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+
+
+// event reported when config.json could not be read
+const EV_CONFIG_ERROR = "configError"
+
+// signals waiting to be played; more than this are dropped
+const signalQueueLength = 16
+
+// longest to wait for the configuration error signal before exiting
+const configErrorWait = 20 * time.Second
+
+
+
+// where a status signal is played
+const(
+    ROUTE_SOUNDER   = "sounder"
+    ROUTE_LED       = "led"
+    ROUTE_OFF       = "off"
+    )
+
+
+
+/**
+ * How one status event is signalled, read from the "signals" section of
+ * config.json.  Text may be plain text, a prosign such as "<SK>", or
+ * raw elements such as "..".  Text may include values set by the client,
+ * such as "{server}", in braces.  Route is "sounder", "led" or "off".
+ */
+type SignalConfig struct {
+    Text    string  `json:"text"`
+    Route   string  `json:"route"`
+}
+
+
+
+/**
+ * Plays status events through the Morse encoder.
+ *
+ * Each event is looked up in the signal table, encoded, and queued for
+ * the sounder or LED player according to its route.  Events with no
+ * entry, no text, or the "off" route are only logged.  The queue is
+ * played in order by a goroutine of its own, so reporting an event
+ * never waits for the sounder.
+ */
+type statusSignaller struct {
+    mutex   sync.Mutex
+    signals map[string]SignalConfig
+    values  map[string]string
+    sounder func(elements string)
+    led     func(elements string)
+    queue   chan queuedSignal
+    pending sync.WaitGroup      // signals queued and not yet played
+}
+
+
+
+// an encoded signal waiting to be played
+type queuedSignal struct {
+    elements    string
+    play        func(elements string)
+}
+
+
+
+/**
+ * Create a status signaller and start its player.
+ *
+ * @param   defaults    the client's built in signals
+ * @param   overrides   signals from config.json, may be nil
+ * @param   sounder     plays elements on the sounder
+ * @param   led         plays elements on the LED, may be nil
+ * @return  ss          the status signaller
+ */
+func newStatusSignaller(defaults, overrides map[string]SignalConfig,
+                        sounder, led func(elements string)) *statusSignaller {
+    ss := &statusSignaller{
+        signals:    mergeSignals(defaults, overrides),
+        values:     make(map[string]string),
+        sounder:    sounder,
+        led:        led,
+        queue:      make(chan queuedSignal, signalQueueLength),
+    }
+    go ss.player()
+    return ss
+}
+
+
+
+/**
+ * Goroutine to play queued signals one after another.
+ */
+func (ss *statusSignaller) player() {
+    for sig := range ss.queue {
+        sig.play(sig.elements)
+        ss.pending.Done()
+    }
+}
+
+
+
+/**
+ * Wait for the queued signals to be played, e.g. before exiting.
+ *
+ * @param   limit   the longest to wait
+ * @return  bool    true if every signal was played in time
+ */
+func (ss *statusSignaller) flush(limit time.Duration) bool {
+    played := make(chan struct{})
+    go func() {
+        ss.pending.Wait()
+        close(played)
+    }()
+    select {
+    case <-played:
+        return true
+    case <-time.After(limit):
+        return false
+    }
+}
+
+
+
+/**
+ * Replace the signal table, e.g. after the configuration is reloaded.
+ *
+ * @param   defaults    the client's built in signals
+ * @param   overrides   signals from config.json, may be nil
+ */
+func (ss *statusSignaller) setSignals(defaults, overrides map[string]SignalConfig) {
+    signals := mergeSignals(defaults, overrides)
+    ss.mutex.Lock()
+    ss.signals = signals
+    ss.mutex.Unlock()
+}
+
+
+
+/**
+ * Overlay configured signals on the defaults.  A configured entry that
+ * only sets the route keeps the default text, and the reverse.
+ *
+ * @param   defaults    the client's built in signals
+ * @param   overrides   signals from config.json
+ * @return  signals     the merged signal table
+ */
+func mergeSignals(defaults, overrides map[string]SignalConfig) map[string]SignalConfig {
+    signals := make(map[string]SignalConfig)
+    for event, sig := range defaults {
+        signals[event] = sig
+    }
+    for event, sig := range overrides {
+        current, known := signals[event]
+        if !known {
+            fmt.Println("signals: unknown event", event, "in config")
+        }
+        if sig.Text != "" {
+            current.Text = sig.Text
+        }
+        if sig.Route != "" {
+            current.Route = sig.Route
+        }
+        signals[event] = current
+    }
+    for event, sig := range signals {
+        if err := checkSignalText(sig.Text); err != nil {
+            fmt.Println("signals:", event, "disabled:", err)
+            sig.Route = ROUTE_OFF
+            signals[event] = sig
+        }
+    }
+    return signals
+}
+
+
+
+/**
+ * Set a value that signal text can include as {name}.
+ *
+ * @param   name    the value's name, without braces
+ * @param   value   text to substitute
+ */
+func (ss *statusSignaller) setValue(name, value string) {
+    ss.mutex.Lock()
+    ss.values[name] = value
+    ss.mutex.Unlock()
+}
+
+
+
+/**
+ * Replace each {name} in signal text with its value.  Names with no
+ * value are left out.
+ *
+ * @param   text    signal text
+ * @param   values  values to substitute
+ * @return  string  the expanded text
+ */
+func expandSignalText(text string, values map[string]string) string {
+    var out strings.Builder
+    for {
+        open := strings.IndexByte(text, '{')
+        if open < 0 {
+            break
+        }
+        length := strings.IndexByte(text[open:], '}')
+        if length < 0 {
+            break
+        }
+        out.WriteString(text[:open])
+        out.WriteString(values[text[open+1:open+length]])
+        text = text[open+length+1:]
+    }
+    out.WriteString(text)
+    return out.String()
+}
+
+
+
+/**
+ * Check that signal text can be encoded, whatever its values turn out
+ * to be.
+ *
+ * @param   text    signal text
+ * @return  error   set if the text cannot be encoded
+ */
+func checkSignalText(text string) error {
+    _, err := encodeMorse(expandSignalText(text, nil))
+    return err
+}
+
+
+
+/**
+ * Signal a status event to the user.  The signal is queued, so this
+ * returns straight away.
+ *
+ * @parent  ss      this function is associated with the
+ *                  statusSignaller structure
+ * @param   event   one of the EV_* events
+ */
+func (ss *statusSignaller) signal(event string) {
+    ss.mutex.Lock()
+    sig, ok := ss.signals[event]
+    text := expandSignalText(sig.Text, ss.values)
+    ss.mutex.Unlock()
+    if !ok || text == "" || ROUTE_OFF == sig.Route {
+        fmt.Println("status event:", event)
+        return
+    }
+
+    elements, err := encodeMorse(text)
+    if err != nil {
+        fmt.Println("status event:", event, "cannot be signalled:", err)
+        return
+    }
+    fmt.Println("status event:", event, "-", text, "on", sig.Route)
+
+    play := ss.sounder
+    if ROUTE_LED == sig.Route && ss.led != nil {
+        play = ss.led
+    }
+    if play == nil {
+        return
+    }
+    ss.pending.Add(1)
+    select {
+    case ss.queue <- queuedSignal{elements: elements, play: play}:
+    default:
+        ss.pending.Done()
+        fmt.Println("status event:", event, "dropped, too many signals waiting")
+    }
+}
+
+/**
+ * Signal that the configuration could not be used, and wait for the
+ * signal to be played so the client does not exit before it is heard.
+ *
+ * @param   ss      the status signaller
+ */
+func signalConfigError(ss *statusSignaller) {
+    ss.signal(EV_CONFIG_ERROR)
+    if !ss.flush(configErrorWait) {
+        fmt.Println("status event:", EV_CONFIG_ERROR, "still playing at exit")
+    }
+}
+
+/* end of file */
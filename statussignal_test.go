@@ -0,0 +1,79 @@
+package main
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+
+
+// a player that takes a while over each signal and notes what it played
+type slowPlayer struct {
+    mutex   sync.Mutex
+    played  []string
+}
+
+func (p *slowPlayer) play(elements string) {
+    time.Sleep(50 * time.Millisecond)
+    p.mutex.Lock()
+    p.played = append(p.played, elements)
+    p.mutex.Unlock()
+}
+
+func (p *slowPlayer) heard() []string {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    return append([]string(nil), p.played...)
+}
+
+
+
+var testSignals = map[string]SignalConfig{
+    EV_CONFIG_ERROR:    {Text: "CFG", Route: ROUTE_SOUNDER},
+    "status":           {Text: "E", Route: ROUTE_SOUNDER},
+}
+
+
+
+func TestSignalDoesNotWaitForThePlayer(t *testing.T) {
+    player := &slowPlayer{}
+    ss := newStatusSignaller(testSignals, nil, player.play, nil)
+    started := time.Now()
+    ss.signal("status")
+    ss.signal("status")
+    if waited := time.Since(started); waited > 25 * time.Millisecond {
+        t.Errorf("signal() waited %v for the player", waited)
+    }
+    if !ss.flush(time.Second) || len(player.heard()) != 2 {
+        t.Errorf("played %v after flushing, want two signals", player.heard())
+    }
+}
+
+
+
+func TestConfigErrorIsPlayedBeforeExiting(t *testing.T) {
+    player := &slowPlayer{}
+    ss := newStatusSignaller(testSignals, nil, player.play, nil)
+    ss.signal("status")                         // something already waiting to be played
+    signalConfigError(ss)
+
+    heard := player.heard()
+    if len(heard) != 2 || heard[1] != "-.-. ..-. --." {
+        t.Errorf("played %v before the exit path returned, want the CFG signal last", heard)
+    }
+}
+
+
+
+func TestFlushGivesUpAfterItsLimit(t *testing.T) {
+    player := &slowPlayer{}
+    ss := newStatusSignaller(testSignals, nil, player.play, nil)
+    ss.signal("status")
+    if ss.flush(time.Millisecond) {
+        t.Error("flush reported a 50ms signal played within 1ms")
+    }
+    ss.flush(time.Second)
+}
+
+/* end of file */
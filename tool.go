@@ -0,0 +1,93 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+)
+
+
+
+/**
+ * Settings the tool shares with the telegraph, read from the client's
+ * config.json.  Keys the tool does not use are ignored, so the config
+ * of either client will do.
+ */
+type toolConfig struct {
+    Server      string          `json:"server"`
+    Port        string          `json:"port"`
+    Channel     string          `json:"channel"`
+    Gpio        bool            `json:"gpio"`
+    SpkrPin     int             `json:"spkrPin"`    // BCM pin the sounder or buzzer is on
+    ToneHz      int             `json:"toneHz"`     // hardware PWM tone for a passive piezo, 0 for on/off
+    ToneDuty    float64         `json:"toneDuty"`
+    Audio       AudioConfig     `json:"audio"`
+}
+
+
+
+/**
+ * Read the telegraph's config file.  A file that does not exist gives
+ * the defaults: the lobby on morse.autodidacts.io, and no sound.
+ *
+ * @param   path    the config file
+ * @return  toolConfig  the settings
+ * @return  error   set if the file could not be read
+ */
+func loadToolConfig(path string) (toolConfig, error) {
+    config := toolConfig{Server: "morse.autodidacts.io", Port: "8000", Channel: "lobby",
+                         SpkrPin: 10, Audio: defaultAudioConfig()}
+    file, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return config, nil
+    }
+    if err != nil {
+        return config, err
+    }
+    defer file.Close()
+    if err := json.NewDecoder(file).Decode(&config); err != nil {
+        return config, fmt.Errorf("%s: %v", path, err)
+    }
+    return config, nil
+}
+
+
+
+// the tool's commands, each given the arguments after its name
+var toolCommands = map[string]func(args []string) error{
+    "replay":   replayCommand,
+    "export":   exportCommand,
+    "decode":   decodeCommand,
+    "analyse":  analyseCommand,
+}
+
+
+
+/**
+ * Telegraph tool: works with recorded sessions away from the telegraph
+ * itself.
+ *
+ *      telegraph-tool <command> [flags] ...
+ *
+ * Run a command with -h for its flags.
+ */
+func main() {
+    if len(os.Args) < 2 || nil == toolCommands[os.Args[1]] {
+        fmt.Fprintln(os.Stderr, "usage: telegraph-tool <command> [flags] ...")
+        var names []string
+        for name := range toolCommands {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        fmt.Fprintln(os.Stderr, "commands:", strings.Join(names, " "))
+        os.Exit(2)
+    }
+    if err := toolCommands[os.Args[1]](os.Args[2:]); err != nil {
+        fmt.Fprintln(os.Stderr, os.Args[1] + ":", err)
+        os.Exit(1)
+    }
+}
+
+/* end of file */